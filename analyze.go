@@ -0,0 +1,264 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/pkg/units"
+)
+
+// tarBlockSize is the size of a tar header and the unit content is padded to.
+const tarBlockSize = 512
+
+type WasteKind string
+
+const (
+	WasteOverwritten WasteKind = "overwritten"
+	WasteDeleted     WasteKind = "deleted"
+	WasteDuplicate   WasteKind = "duplicate"
+)
+
+// Waste is content stored in a layer that is not needed in the final
+// filesystem, or is stored more than once.
+type Waste struct {
+	Path  string
+	Layer string // id of the layer holding the wasted content
+	Kind  WasteKind
+	Size  int64
+}
+
+// Savings is the number of bytes saved by squashing every layer above
+// Start into one layer.
+type Savings struct {
+	Start *ExportedImage
+	Bytes int64
+}
+
+// Analysis describes the wasted space of an export.
+type Analysis struct {
+	Layers  []*ExportedImage
+	Total   int64 // bytes of file content stored in all layers
+	Waste   []*Waste
+	Savings []*Savings
+
+	// Sizes are the layer.tar sizes of each layer and Squashed the
+	// estimated layer.tar size of squashing every layer above each layer.
+	Sizes    []int64
+	Squashed []int64
+}
+
+// Wasted returns the total bytes of waste of the given kind.
+func (a *Analysis) Wasted(kind WasteKind) int64 {
+	size := int64(0)
+	for _, w := range a.Waste {
+		if w.Kind == kind {
+			size += w.Size
+		}
+	}
+	return size
+}
+
+// Best returns the start layer with the highest savings.  When several
+// start layers save the same, the last one is used so that as many layers
+// as possible are kept.
+func (a *Analysis) Best() *Savings {
+	var best *Savings
+	for _, s := range a.Savings {
+		if best == nil || s.Bytes >= best.Bytes {
+			best = s
+		}
+	}
+	return best
+}
+
+// Analyze replays the layers of the export from their tar headers and
+// content hashes and computes the wasted space and the squash savings for
+// each possible start layer.  Nothing is extracted.
+func (e *Export) Analyze() (*Analysis, error) {
+	analysis := &Analysis{
+		Layers: e.Chain(),
+	}
+
+	index := map[string]int{}
+	written := make([]int64, len(analysis.Layers))
+	digests := map[string]string{}
+
+	fi := FileIndex{}
+	for i, entry := range analysis.Layers {
+		id := entry.LayerConfig.Id
+		index[id] = i
+
+		entries, err := readLayerEntries(entry.LayerTarPath, true)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, le := range entries {
+			if !isRegular(le.Header) {
+				continue
+			}
+			written[i] += le.Header.Size
+
+			if le.Header.Size == 0 {
+				continue
+			}
+			if p, ok := digests[le.Digest]; ok && p != le.Path {
+				analysis.Waste = append(analysis.Waste, &Waste{
+					Path:  le.Path,
+					Layer: id,
+					Kind:  WasteDuplicate,
+					Size:  le.Header.Size,
+				})
+			} else if !ok {
+				digests[le.Digest] = le.Path
+			}
+		}
+		analysis.Total += written[i]
+
+		for _, c := range fi.apply(id, entries) {
+			kind := WasteOverwritten
+			if c.Kind == ChangeDelete {
+				kind = WasteDeleted
+			}
+			for _, r := range c.Replaced {
+				if !isRegular(r.Header) || r.Header.Size == 0 {
+					continue
+				}
+				analysis.Waste = append(analysis.Waste, &Waste{
+					Path:  r.Path,
+					Layer: r.Layer,
+					Kind:  kind,
+					Size:  r.Header.Size,
+				})
+			}
+		}
+	}
+	sort.Sort(wasteBySize(analysis.Waste))
+
+	// Bytes of the final filesystem written by each layer, as content and
+	// as tar blocks.
+	kept := make([]int64, len(analysis.Layers))
+	keptTar := make([]int64, len(analysis.Layers))
+	for _, f := range fi {
+		i := index[f.Layer]
+		keptTar[i] += tarSize(f)
+		if isRegular(f.Header) {
+			kept[i] += f.Header.Size
+		}
+	}
+
+	for _, entry := range analysis.Layers {
+		size := int64(0)
+		if stat, err := os.Stat(entry.LayerTarPath); err == nil {
+			size = stat.Size()
+		}
+		analysis.Sizes = append(analysis.Sizes, size)
+	}
+
+	for start := 0; start < len(analysis.Layers)-1; start++ {
+		s := &Savings{Start: analysis.Layers[start]}
+		squashed := int64(2 * tarBlockSize)
+		for i := start + 1; i < len(analysis.Layers); i++ {
+			s.Bytes += written[i] - kept[i]
+			squashed += keptTar[i]
+		}
+		analysis.Savings = append(analysis.Savings, s)
+		analysis.Squashed = append(analysis.Squashed, squashed)
+	}
+
+	return analysis, nil
+}
+
+// tarSize returns the bytes an entry takes in a tar archive.
+func tarSize(entry *FileEntry) int64 {
+	if entry == nil {
+		return 0
+	}
+	size := int64(tarBlockSize)
+	if isRegular(entry.Header) {
+		size += (entry.Header.Size + tarBlockSize - 1) / tarBlockSize * tarBlockSize
+	}
+	return size
+}
+
+type wasteBySize []*Waste
+
+func (w wasteBySize) Len() int      { return len(w) }
+func (w wasteBySize) Swap(i, j int) { w[i], w[j] = w[j], w[i] }
+func (w wasteBySize) Less(i, j int) bool {
+	if w[i].Size == w[j].Size {
+		return w[i].Path < w[j].Path
+	}
+	return w[i].Size > w[j].Size
+}
+
+func runAnalyze(args []string) {
+	var input string
+	var keepTemp bool
+	var top int
+
+	flags := flag.NewFlagSet("analyze", flag.ExitOnError)
+	flags.StringVar(&input, "i", "", "Read from a tar archive file, instead of STDIN")
+	flags.IntVar(&top, "n", 20, "Number of wasted paths to list")
+	flags.BoolVar(&keepTemp, "keepTemp", false, "Keep temp dir when done. (Useful for debugging)")
+	flags.BoolVar(&verbose, "verbose", false, "Enable verbose logging")
+	flags.Usage = func() {
+		fmt.Printf("\nUsage: docker-squash analyze [options]\n\n")
+		fmt.Printf("Reports the space wasted by the layers of a tar archive without squashing it\n\n")
+		fmt.Printf("Options:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	tempdir := setupTempdir(keepTemp)
+
+	export, err := LoadExport(input, tempdir)
+	if err != nil {
+		fatal(err)
+	}
+
+	analysis, err := export.Analyze()
+	if err != nil {
+		fatal(err)
+	}
+
+	wasted := int64(0)
+	for _, w := range analysis.Waste {
+		wasted += w.Size
+	}
+
+	fmt.Printf("Layers: %d, content: %s, wasted: %s\n", len(analysis.Layers),
+		units.HumanSize(float64(analysis.Total)), units.HumanSize(float64(wasted)))
+	for _, kind := range []WasteKind{WasteOverwritten, WasteDeleted, WasteDuplicate} {
+		fmt.Printf("  -  %-12s %s\n", kind, units.HumanSize(float64(analysis.Wasted(kind))))
+	}
+
+	fmt.Printf("\nLargest wasted paths:\n")
+	for i, w := range analysis.Waste {
+		if i == top {
+			break
+		}
+		fmt.Printf("  -  %-10s %-12s %s %s\n", units.HumanSize(float64(w.Size)), w.Kind,
+			w.Layer[0:12], w.Path)
+	}
+
+	fmt.Printf("\nSquash savings by -from layer:\n")
+	for _, s := range analysis.Savings {
+		cmd := strings.Join(s.Start.LayerConfig.ContainerConfig().Cmd, " ")
+		if len(cmd) > 50 {
+			cmd = cmd[:47] + "..."
+		}
+		fmt.Printf("  -  %s %-10s %s\n", s.Start.LayerConfig.Id[0:12],
+			units.HumanSize(float64(s.Bytes)), cmd)
+	}
+
+	if best := analysis.Best(); best != nil {
+		fmt.Printf("\nBest -from: %s (saves %s)\n", best.Start.LayerConfig.Id[0:12],
+			units.HumanSize(float64(best.Bytes)))
+	}
+
+	cleanup()
+}
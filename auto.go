@@ -0,0 +1,86 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/pkg/units"
+)
+
+// CostModel weighs the bytes that must be pushed for the layers of a
+// squashed image against the bytes of layers it still shares with base
+// images, which registries and hosts already have.
+type CostModel struct {
+	Shared       map[string]bool // ids of layers present in base images
+	SharedWeight float64
+}
+
+// Cost returns the bytes pushed, the bytes shared and the resulting cost of
+// squashing every layer above layer start.
+func (m *CostModel) Cost(a *Analysis, start int) (pushed, shared int64, cost float64) {
+	for i := 0; i <= start; i++ {
+		if m.Shared[a.Layers[i].LayerConfig.Id] {
+			shared += a.Sizes[i]
+		} else {
+			pushed += a.Sizes[i]
+		}
+	}
+	pushed += a.Squashed[start]
+	return pushed, shared, float64(pushed) - m.SharedWeight*float64(shared)
+}
+
+// AutoStart evaluates every possible start layer and returns the one with
+// the lowest cost.  Ties go to the later layer so that as many layers as
+// possible are kept.
+func (e *Export) AutoStart(m *CostModel) (*ExportedImage, error) {
+	analysis, err := e.Analyze()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(analysis.Savings) == 0 {
+		return nil, errors.New("image has a single layer. Nothing to squash.")
+	}
+
+	debug("Evaluating squash points...")
+	best, bestCost := 0, 0.0
+	for start := range analysis.Savings {
+		pushed, shared, cost := m.Cost(analysis, start)
+		debugf("  -  %s pushed %s, shared %s\n", analysis.Layers[start].LayerConfig.Id[0:12],
+			units.HumanSize(float64(pushed)), units.HumanSize(float64(shared)))
+		if start == 0 || cost <= bestCost {
+			best, bestCost = start, cost
+		}
+	}
+	return analysis.Layers[best], nil
+}
+
+// readLayerIds returns the ids of the layers in a tar archive created by
+// docker save, reading only its headers.
+func readLayerIds(archive string) (map[string]bool, error) {
+	f, err := openCompressed(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ids := map[string]bool{}
+	t := tar.NewReader(f)
+	for {
+		header, err := t.Next()
+		if err != nil {
+			if err == io.EOF {
+				return ids, nil
+			}
+			return nil, err
+		}
+
+		dir, base := path.Split(path.Clean(header.Name))
+		if base == "json" && dir != "" {
+			ids[strings.Trim(dir, "/")] = true
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// BaseImage is the layer chain of a base image, ordered from its root.
+type BaseImage struct {
+	Ids     []string // layer ids, empty for OCI layouts
+	DiffIds []string // digests of the uncompressed layer tars
+}
+
+// LoadBaseImage reads the layer chain of a tar archive created by docker
+// save, or of a directory holding an OCI image layout.
+func LoadBaseImage(p string) (*BaseImage, error) {
+	stat, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if stat.IsDir() {
+		return loadOCIBase(p)
+	}
+	return loadArchiveBase(p)
+}
+
+func loadArchiveBase(archive string) (*BaseImage, error) {
+	f, err := openCompressed(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	parents := map[string]string{}
+	digests := map[string]string{}
+
+	t := tar.NewReader(f)
+	for {
+		header, err := t.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+
+		dir, base := path.Split(path.Clean(header.Name))
+		id := strings.Trim(dir, "/")
+		switch base {
+		case "json":
+			if id == "" {
+				continue
+			}
+			config := &LayerConfig{}
+			if err := json.NewDecoder(t).Decode(config); err != nil {
+				return nil, err
+			}
+			parents[config.Id] = config.Parent
+		case "layer.tar":
+			h := sha256.New()
+			if _, err := io.Copy(h, t); err != nil {
+				return nil, err
+			}
+			digests[id] = "sha256:" + hex.EncodeToString(h.Sum(nil))
+		}
+	}
+
+	image := &BaseImage{}
+	for parent := ""; ; {
+		children := []string{}
+		for id, p := range parents {
+			if p == parent {
+				children = append(children, id)
+			}
+		}
+
+		if len(children) == 0 {
+			break
+		}
+		if len(children) > 1 {
+			return nil, errors.New(fmt.Sprintf("%s has several images in it. "+
+				"It needs to be generated from a specific image ID or tag.", archive))
+		}
+
+		image.Ids = append(image.Ids, children[0])
+		image.DiffIds = append(image.DiffIds, digests[children[0]])
+		parent = children[0]
+	}
+	return image, nil
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType,omitempty"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+}
+
+type ociIndex struct {
+	MediaType string          `json:"mediaType,omitempty"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+type ociConfig struct {
+	RootFS struct {
+		DiffIds []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+func loadOCIBase(layout string) (*BaseImage, error) {
+	index := &ociIndex{}
+	err := readJsonFile(filepath.Join(layout, "index.json"), index)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(index.Manifests) != 1 {
+		return nil, errors.New(fmt.Sprintf("%s has %d manifests. Expected one.", layout,
+			len(index.Manifests)))
+	}
+
+	manifest := &ociManifest{}
+	err = readJsonFile(ociBlobPath(layout, index.Manifests[0].Digest), manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ociConfig{}
+	err = readJsonFile(ociBlobPath(layout, manifest.Config.Digest), config)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(config.RootFS.DiffIds) == 0 {
+		return nil, errors.New(fmt.Sprintf("%s has no layers", layout))
+	}
+	return &BaseImage{DiffIds: config.RootFS.DiffIds}, nil
+}
+
+func ociBlobPath(layout, digest string) string {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 {
+		return filepath.Join(layout, "blobs", digest)
+	}
+	return filepath.Join(layout, "blobs", parts[0], parts[1])
+}
+
+// MatchBase returns the topmost layer of the export that belongs to the
+// base image, or nil if the export isn't built on it.  Layers are matched in
+// order from the root by layer ID or by the digest of their layer tar.
+func (e *Export) MatchBase(base *BaseImage) (*ExportedImage, error) {
+	var top *ExportedImage
+	for i, entry := range e.Chain() {
+		if i >= len(base.DiffIds) {
+			break
+		}
+
+		if i < len(base.Ids) && base.Ids[i] == entry.LayerConfig.Id {
+			top = entry
+			continue
+		}
+
+		diffId, err := entry.DiffId()
+		if err != nil {
+			return nil, err
+		}
+		if diffId != base.DiffIds[i] {
+			break
+		}
+		top = entry
+	}
+	return top, nil
+}
+
+// CheckBase returns an error if one of the ranges squashes a layer of the
+// base image ending at layer top.
+func (e *Export) CheckBase(top *ExportedImage, ranges []*SquashRange) error {
+	base := map[*ExportedImage]bool{}
+	for _, entry := range e.Chain() {
+		base[entry] = true
+		if entry == top {
+			break
+		}
+	}
+
+	for _, r := range ranges {
+		layers, err := e.Layers(r)
+		if err != nil {
+			return err
+		}
+		for _, entry := range layers {
+			if base[entry] {
+				return errors.New(fmt.Sprintf("squashing from %s would squash base layer %s",
+					r.Start.LayerConfig.Id[:12], entry.LayerConfig.Id[:12]))
+			}
+		}
+	}
+	return nil
+}
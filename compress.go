@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Compression is the compression format of a stream.
+type Compression int
+
+const (
+	Uncompressed Compression = iota
+	Gzip
+	Bzip2
+	Xz
+	Zstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case Gzip:
+		return "gzip"
+	case Bzip2:
+		return "bzip2"
+	case Xz:
+		return "xz"
+	case Zstd:
+		return "zstd"
+	}
+	return "uncompressed"
+}
+
+var compressionMagic = []struct {
+	compression Compression
+	magic       []byte
+}{
+	{Gzip, []byte{0x1f, 0x8b}},
+	{Bzip2, []byte("BZh")},
+	{Xz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{Zstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// detectCompression returns the compression format of a stream starting
+// with header.
+func detectCompression(header []byte) Compression {
+	for _, m := range compressionMagic {
+		if bytes.HasPrefix(header, m.magic) {
+			return m.compression
+		}
+	}
+	return Uncompressed
+}
+
+// decompressStream returns a reader of the decompressed content of r.  The
+// format is detected from the first bytes of r, and uncompressed streams are
+// read as is.  xz and zstd streams are decompressed by the xz and zstd
+// commands.
+func decompressStream(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(6)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch compression := detectCompression(header); compression {
+	case Gzip:
+		return gzip.NewReader(br)
+	case Bzip2:
+		return ioutil.NopCloser(bzip2.NewReader(br)), nil
+	case Xz, Zstd:
+		return commandReader(br, compression.String(), "-dc")
+	}
+	return ioutil.NopCloser(br), nil
+}
+
+// openCompressed opens a file that may be compressed and returns a reader of
+// its decompressed content.
+func openCompressed(p string) (io.ReadCloser, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := decompressStream(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.New(fmt.Sprintf("%s: %s", p, err))
+	}
+	return &fileReader{ReadCloser: r, f: f}, nil
+}
+
+type fileReader struct {
+	io.ReadCloser
+	f *os.File
+}
+
+func (r *fileReader) Close() error {
+	r.ReadCloser.Close()
+	return r.f.Close()
+}
+
+// cmdReader reads the output of a command filtering a stream.  Errors of the
+// command are returned by Read once its output is consumed.
+type cmdReader struct {
+	cmd    *exec.Cmd
+	out    io.ReadCloser
+	stderr *bytes.Buffer
+	done   bool
+}
+
+func commandReader(r io.Reader, name string, args ...string) (io.ReadCloser, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = r
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdReader{cmd: cmd, out: out, stderr: stderr}, nil
+}
+
+func (c *cmdReader) Read(p []byte) (int, error) {
+	n, err := c.out.Read(p)
+	if err == io.EOF && !c.done {
+		c.done = true
+		if werr := c.cmd.Wait(); werr != nil {
+			return n, errors.New(fmt.Sprintf("%s: %s %s", c.cmd.Path, werr,
+				strings.TrimSpace(c.stderr.String())))
+		}
+	}
+	return n, err
+}
+
+func (c *cmdReader) Close() error {
+	if c.done {
+		return nil
+	}
+	c.done = true
+	c.out.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	return nil
+}
+
+// ParseCompression returns the output compression named by name: gzip, zstd
+// or none.
+func ParseCompression(name string) (Compression, error) {
+	switch name {
+	case "", "none":
+		return Uncompressed, nil
+	case "gzip":
+		return Gzip, nil
+	case "zstd":
+		return Zstd, nil
+	}
+	return Uncompressed, errors.New(fmt.Sprintf("unsupported compression: %s. Use gzip or zstd", name))
+}
+
+// CheckCompressionLevel returns an error if level isn't a level of c.  A
+// level of 0 is the default level of any format.
+func CheckCompressionLevel(c Compression, level int) error {
+	min, max := 0, 0
+	switch c {
+	case Gzip:
+		min, max = gzip.HuffmanOnly, gzip.BestCompression
+	case Zstd:
+		min, max = 1, 19
+	}
+	if level != 0 && (level < min || level > max) {
+		return errors.New(fmt.Sprintf("bad %s compression level %d", c, level))
+	}
+	return nil
+}
+
+// compressStream returns a writer compressing to w.  A level of 0 uses the
+// default level of the format.  Close must be called to flush the stream.
+func compressStream(w io.Writer, c Compression, level int) (io.WriteCloser, error) {
+	if err := CheckCompressionLevel(c, level); err != nil {
+		return nil, err
+	}
+
+	switch c {
+	case Uncompressed:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return newParallelGzipWriter(w, level), nil
+	case Zstd:
+		args := []string{"-q", "-c", "-T0"}
+		if level != 0 {
+			args = append(args, fmt.Sprintf("-%d", level))
+		}
+		return commandWriter(w, "zstd", args...)
+	}
+	return nil, errors.New(fmt.Sprintf("cannot compress with %s", c))
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// gzipBlockSize is the size of the blocks compressed concurrently by a
+// parallelGzipWriter.
+const gzipBlockSize = 1 << 20
+
+// parallelGzipWriter compresses blocks of its input concurrently and writes
+// each block as a gzip member, in order.  gzip readers decompress the members
+// as a single stream.
+type parallelGzipWriter struct {
+	w      io.Writer
+	level  int
+	buf    []byte
+	blocks int
+	queue  chan chan []byte
+	done   chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+func newParallelGzipWriter(w io.Writer, level int) *parallelGzipWriter {
+	p := &parallelGzipWriter{
+		w:     w,
+		level: level,
+		queue: make(chan chan []byte, runtime.NumCPU()),
+		done:  make(chan struct{}),
+	}
+
+	go func() {
+		defer close(p.done)
+		for result := range p.queue {
+			block := <-result
+			if p.firstError() != nil {
+				continue
+			}
+			if _, err := p.w.Write(block); err != nil {
+				p.setError(err)
+			}
+		}
+	}()
+	return p
+}
+
+func (p *parallelGzipWriter) firstError() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *parallelGzipWriter) setError(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+func (p *parallelGzipWriter) Write(b []byte) (int, error) {
+	if err := p.firstError(); err != nil {
+		return 0, err
+	}
+
+	n := len(b)
+	for len(b) > 0 {
+		c := gzipBlockSize - len(p.buf)
+		if c > len(b) {
+			c = len(b)
+		}
+		p.buf = append(p.buf, b[:c]...)
+		b = b[c:]
+		if len(p.buf) == gzipBlockSize {
+			p.flushBlock()
+		}
+	}
+	return n, nil
+}
+
+func (p *parallelGzipWriter) flushBlock() {
+	block := p.buf
+	p.buf = make([]byte, 0, gzipBlockSize)
+	p.blocks++
+
+	result := make(chan []byte, 1)
+	p.queue <- result
+	go func() {
+		out := &bytes.Buffer{}
+		gz, _ := gzip.NewWriterLevel(out, p.level)
+		gz.Write(block)
+		gz.Close()
+		result <- out.Bytes()
+	}()
+}
+
+func (p *parallelGzipWriter) Close() error {
+	if len(p.buf) > 0 || p.blocks == 0 {
+		p.flushBlock()
+	}
+	close(p.queue)
+	<-p.done
+	return p.firstError()
+}
+
+// cmdWriter writes to a command filtering a stream to another writer.
+type cmdWriter struct {
+	cmd    *exec.Cmd
+	in     io.WriteCloser
+	stderr *bytes.Buffer
+}
+
+func commandWriter(w io.Writer, name string, args ...string) (io.WriteCloser, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = w
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdWriter{cmd: cmd, in: in, stderr: stderr}, nil
+}
+
+func (c *cmdWriter) Write(b []byte) (int, error) {
+	return c.in.Write(b)
+}
+
+func (c *cmdWriter) Close() error {
+	c.in.Close()
+	if err := c.cmd.Wait(); err != nil {
+		return errors.New(fmt.Sprintf("%s: %s %s", c.cmd.Path, err, strings.TrimSpace(c.stderr.String())))
+	}
+	return nil
+}
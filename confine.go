@@ -0,0 +1,152 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// UnsafeEntryError is a tar entry that would write, link or delete files
+// outside of the directory it's extracted to.  Layer is empty for entries
+// of the export itself.
+type UnsafeEntryError struct {
+	Layer  string
+	Name   string
+	Reason string
+}
+
+func (e *UnsafeEntryError) Error() string {
+	if e.Layer == "" {
+		return fmt.Sprintf("unsafe entry %s: %s", e.Name, e.Reason)
+	}
+	return fmt.Sprintf("layer %s: unsafe entry %s: %s", truncateID(e.Layer), e.Name, e.Reason)
+}
+
+// relativeName returns the tar entry name as a cleaned path relative to the
+// extraction root.  Absolute names and names with .. components are
+// rejected.
+func relativeName(name string) (string, error) {
+	if strings.HasPrefix(name, "/") {
+		return "", errors.New("absolute path")
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", errors.New("path has a .. component")
+		}
+	}
+	return path.Clean(name), nil
+}
+
+// checkParents returns an error if a parent dir of the relative path p
+// under root is a symlink, which would redirect the path out of root.
+func checkParents(root, p string) error {
+	dir := path.Dir(p)
+	if dir == "." {
+		return nil
+	}
+
+	current := root
+	for _, part := range strings.Split(dir, "/") {
+		current = filepath.Join(current, part)
+		fi, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			rel, _ := filepath.Rel(root, current)
+			return errors.New(fmt.Sprintf("parent %s is a symlink", rel))
+		}
+	}
+	return nil
+}
+
+// confineLayer checks that the entries of a layer stay within location
+// before they are extracted there.  Entry and hard link names must be
+// relative without .. components, and no entry may be written or hard link
+// point below a symlink, whether it was extracted by an earlier layer or
+// comes earlier in this one.  Files, links and dirs already at a path the
+// layer writes with a different type are removed so that extracting the
+// layer never writes through them.
+func confineLayer(layer, location string, entries []*layerEntry) error {
+	symlinks := map[string]bool{}
+	// checkSymlinks returns an error if a parent dir of the relative path p
+	// is a symlink of the layer or of the layers below it.
+	checkSymlinks := func(p string) error {
+		for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+			if symlinks[dir] {
+				return errors.New(fmt.Sprintf("parent %s is a symlink", dir))
+			}
+		}
+		return checkParents(location, p)
+	}
+
+	for _, le := range entries {
+		name, err := relativeName(le.Header.Name)
+		if err != nil {
+			return &UnsafeEntryError{Layer: layer, Name: le.Header.Name, Reason: err.Error()}
+		}
+		if name == "." {
+			continue
+		}
+
+		if err := checkSymlinks(name); err != nil {
+			return &UnsafeEntryError{Layer: layer, Name: le.Header.Name, Reason: err.Error()}
+		}
+
+		switch le.Header.Typeflag {
+		case tar.TypeLink:
+			target, err := relativeName(le.Header.Linkname)
+			if err == nil {
+				err = checkSymlinks(target)
+			}
+			if err != nil {
+				return &UnsafeEntryError{Layer: layer, Name: le.Header.Name,
+					Reason: fmt.Sprintf("hard link to %s: %s", le.Header.Linkname, err)}
+			}
+		case tar.TypeSymlink:
+			symlinks[name] = true
+		case tar.TypeDir:
+			delete(symlinks, name)
+		}
+
+		if _, _, ok := le.whiteout(); ok {
+			continue
+		}
+
+		fn := filepath.Join(location, name)
+		fi, err := os.Lstat(fn)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && le.Header.Typeflag == tar.TypeDir {
+			continue
+		}
+		if err := os.RemoveAll(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeConfined removes the relative path p under root, refusing to go
+// through symlinked parent dirs.
+func removeConfined(root, p string) error {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil
+	}
+	if err := checkParents(root, p); err != nil {
+		return &UnsafeEntryError{Name: p, Reason: err.Error()}
+	}
+	return os.RemoveAll(filepath.Join(root, p))
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "docker-squash-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func symlinkEntry(name, target string) *tar.Header {
+	return &tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: target, Mode: 0777}
+}
+
+func hardlinkEntry(name, target string) *tar.Header {
+	return &tar.Header{Name: name, Typeflag: tar.TypeLink, Linkname: target, Mode: 0644}
+}
+
+func fileHeader(name string) *tar.Header {
+	return &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}
+}
+
+func dirHeader(name string) *tar.Header {
+	return &tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755}
+}
+
+func headersTar(t *testing.T, headers ...*tar.Header) []byte {
+	b := &bytes.Buffer{}
+	tw := tar.NewWriter(b)
+	for _, h := range headers {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// layerEntries returns the entries of a layer tar with the headers.
+func layerEntries(t *testing.T, headers ...*tar.Header) []*layerEntry {
+	p := filepath.Join(testTempDir(t), "layer.tar")
+	if err := ioutil.WriteFile(p, headersTar(t, headers...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readLayerEntries(p, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestRelativeName(t *testing.T) {
+	for name, want := range map[string]string{
+		"etc/passwd":    "etc/passwd",
+		"./etc/passwd":  "etc/passwd",
+		"etc//a/./b/":   "etc/a/b",
+		"./":            ".",
+		"etc/..passwd":  "etc/..passwd",
+		"etc/passwd..":  "etc/passwd..",
+		"..etc/passwd":  "..etc/passwd",
+		"/etc/passwd":   "",
+		"../etc/passwd": "",
+		"etc/../../x":   "",
+		"etc/..":        "",
+	} {
+		got, err := relativeName(name)
+		if want == "" {
+			if err == nil {
+				t.Errorf("%s was accepted as %s", name, got)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Errorf("%s is %q, %v, want %q", name, got, err, want)
+		}
+	}
+}
+
+func TestConfineLayerRejects(t *testing.T) {
+	tests := map[string][]*tar.Header{
+		"escape":                  {fileHeader("../etc/passwd")},
+		"nested escape":           {dirHeader("etc/"), fileHeader("etc/../../passwd")},
+		"absolute name":           {fileHeader("/etc/passwd")},
+		"write below symlink":     {symlinkEntry("etc", "/etc"), fileHeader("etc/passwd")},
+		"write below relative":    {symlinkEntry("lib", "../../.."), dirHeader("lib/x/")},
+		"write below nested link": {dirHeader("a/"), symlinkEntry("a/b", "/"), fileHeader("a/b/c/d")},
+		"hard link escape":        {hardlinkEntry("passwd", "../../etc/passwd")},
+		"absolute hard link":      {hardlinkEntry("passwd", "/etc/passwd")},
+		"hard link below symlink": {symlinkEntry("etc", "/etc"), hardlinkEntry("etc/passwd", "shadow")},
+		"hard link through link":  {symlinkEntry("etc", "/etc"), hardlinkEntry("shadow", "etc/shadow")},
+	}
+	for name, headers := range tests {
+		err := confineLayer("layer", testTempDir(t), layerEntries(t, headers...))
+		if _, ok := err.(*UnsafeEntryError); !ok {
+			t.Errorf("%s: got error %v, want an unsafe entry", name, err)
+		}
+	}
+}
+
+func TestConfineLayerRejectsExtractedSymlinks(t *testing.T) {
+	outside := testTempDir(t)
+	if err := ioutil.WriteFile(filepath.Join(outside, "passwd"), []byte("root"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// as extracted by a lower layer
+	location := testTempDir(t)
+	if err := os.Symlink(outside, filepath.Join(location, "etc")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string][]*tar.Header{
+		"write":     {fileHeader("etc/passwd")},
+		"hard link": {hardlinkEntry("passwd", "etc/passwd")},
+	}
+	for name, headers := range tests {
+		err := confineLayer("layer", location, layerEntries(t, headers...))
+		if _, ok := err.(*UnsafeEntryError); !ok {
+			t.Errorf("%s: got error %v, want an unsafe entry", name, err)
+		}
+	}
+
+	if err := removeConfined(location, "etc/passwd"); err == nil {
+		t.Error("removed a file below a symlink")
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(outside, "passwd")); err != nil || string(b) != "root" {
+		t.Errorf("file outside of the layer was changed: %q, %v", b, err)
+	}
+}
+
+func TestConfineLayerAccepts(t *testing.T) {
+	location := testTempDir(t)
+	if err := os.Symlink("/usr/lib", filepath.Join(location, "lib")); err != nil {
+		t.Fatal(err)
+	}
+
+	err := confineLayer("layer", location, layerEntries(t,
+		dirHeader("usr/"),
+		dirHeader("usr/bin/"),
+		fileHeader("usr/bin/bash"),
+		symlinkEntry("bin", "usr/bin"),
+		symlinkEntry("usr/bin/sh", "/usr/bin/bash"),
+		symlinkEntry("usr/bin/rbash", "../../../../usr/bin/bash"),
+		hardlinkEntry("usr/bin/bash.hard", "usr/bin/bash"),
+		hardlinkEntry("usr/bin/sh.hard", "./usr/bin/sh"),
+		// replaces the symlink of the lower layer with a dir
+		dirHeader("lib/"),
+		fileHeader("lib/libc.so"),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Lstat(filepath.Join(location, "lib")); err == nil {
+		t.Errorf("symlink replaced by a dir is still there: %s", fi.Mode())
+	}
+}
+
+func TestRemoveConfined(t *testing.T) {
+	location := testTempDir(t)
+	for _, dir := range []string{"etc", "x"} {
+		if err := os.Mkdir(filepath.Join(location, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// cleaned to x below the root, rather than a sibling of it
+	if err := removeConfined(filepath.Join(location, "etc"), "../../x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(location, "x")); err != nil {
+		t.Errorf("whiteout removed a dir outside of the layer: %s", err)
+	}
+}
+
+func TestExtractLinks(t *testing.T) {
+	build := func(links ...*tar.Header) []byte {
+		b := &bytes.Buffer{}
+		tw := tar.NewWriter(b)
+		tw.WriteHeader(dirHeader("a/"))
+		tw.WriteHeader(&tar.Header{Name: "a/layer.tar", Typeflag: tar.TypeReg, Mode: 0644, Size: 4})
+		tw.Write([]byte("data"))
+		tw.WriteHeader(dirHeader("b/"))
+		for _, h := range links {
+			tw.WriteHeader(h)
+		}
+		tw.Close()
+		return b.Bytes()
+	}
+
+	for name, link := range map[string]*tar.Header{
+		"symlink":   symlinkEntry("b/layer.tar", "../a/layer.tar"),
+		"hard link": hardlinkEntry("b/layer.tar", "a/layer.tar"),
+	} {
+		export := &Export{Path: testTempDir(t)}
+		if err := export.Extract(bytes.NewReader(build(link))); err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(export.Path, "b", "layer.tar"))
+		if err != nil || string(b) != "data" {
+			t.Errorf("%s: b/layer.tar has %q, %v", name, b, err)
+		}
+	}
+
+	for name, link := range map[string]*tar.Header{
+		"symlink escape":     symlinkEntry("b/layer.tar", "../../etc/passwd"),
+		"absolute symlink":   symlinkEntry("b/layer.tar", "/etc/passwd"),
+		"hard link escape":   hardlinkEntry("b/layer.tar", "../etc/passwd"),
+		"absolute hard link": hardlinkEntry("b/layer.tar", "/etc/passwd"),
+		"symlink to a dir":   symlinkEntry("b/layer.tar", "../a"),
+	} {
+		export := &Export{Path: testTempDir(t)}
+		err := export.Extract(bytes.NewReader(build(link)))
+		if _, ok := err.(*UnsafeEntryError); !ok {
+			t.Errorf("%s: got error %v, want an unsafe entry", name, err)
+		}
+	}
+}
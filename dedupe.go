@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// dedupeKey identifies regular files that can share an inode: the same
+// content, mode, owner and xattrs.
+type dedupeKey struct {
+	digest string
+	mode   os.FileMode
+	uid    uint32
+	gid    uint32
+	xattrs string
+}
+
+// Dedupe replaces the regular files of the squashed layer dir that are
+// identical to an earlier file, in path order, with hard links to it.  Paths
+// matching excludes are left alone.  The number of files linked and the
+// bytes saved are returned.  Linked files take the mtime of the first copy.
+func (e *ExportedImage) Dedupe(excludes []string) (int, int64, error) {
+	first := map[dedupeKey]string{}
+	inodes := map[uint64]bool{}
+	linked, saved := 0, int64(0)
+
+	err := filepath.Walk(e.LayerDirPath, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || fi.Size() == 0 {
+			return nil
+		}
+
+		rel, err := filepath.Rel(e.LayerDirPath, p)
+		if err != nil {
+			return err
+		}
+		if excluded("/"+filepath.ToSlash(rel), excludes) {
+			return nil
+		}
+
+		stat := fi.Sys().(*syscall.Stat_t)
+		if inodes[uint64(stat.Ino)] {
+			return nil
+		}
+		inodes[uint64(stat.Ino)] = true
+
+		digest, err := hashFile(p)
+		if err != nil {
+			return err
+		}
+		attrs, err := listXattrs(p)
+		if err != nil {
+			return err
+		}
+
+		key := dedupeKey{
+			digest: digest,
+			mode:   fi.Mode(),
+			uid:    stat.Uid,
+			gid:    stat.Gid,
+			xattrs: strings.Join(attrs, " "),
+		}
+		target, ok := first[key]
+		if !ok {
+			first[key] = p
+			return nil
+		}
+
+		debugf("  -  Linking %s to %s\n", rel, target[len(e.LayerDirPath):])
+		tmp := p + ".dedupe"
+		if err := os.Link(target, tmp); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, p); err != nil {
+			return err
+		}
+		linked++
+		saved += fi.Size()
+		return nil
+	})
+	return linked, saved, err
+}
+
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"archive/tar"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/pkg/units"
+)
+
+func runDiff(args []string) {
+	var input, compare string
+	var keepTemp bool
+	var excludes stringsFlag
+
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	flags.StringVar(&input, "i", "", "Read from a tar archive file, instead of STDIN")
+	flags.StringVar(&compare, "compare", "", "Compare the final filesystem with another tar archive")
+	flags.Var(&excludes, "exclude", "Ignore paths matching pattern when comparing (may be repeated)")
+	flags.BoolVar(&keepTemp, "keepTemp", false, "Keep temp dir when done. (Useful for debugging)")
+	flags.BoolVar(&verbose, "verbose", false, "Enable verbose logging")
+	flags.Usage = func() {
+		fmt.Printf("\nUsage: docker-squash diff [options] [layer]\n\n")
+		fmt.Printf("Lists the paths added, modified and deleted by each layer of a tar archive\n\n")
+		fmt.Printf("Options:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	tempdir := setupTempdir(keepTemp)
+
+	export, err := LoadExport(input, filepath.Join(tempdir, "a"))
+	if err != nil {
+		fatal(err)
+	}
+
+	if compare != "" {
+		other, err := LoadExport(compare, filepath.Join(tempdir, "b"))
+		if err != nil {
+			fatal(err)
+		}
+
+		differences, err := compareExports(export, other, excludes)
+		if err != nil {
+			fatal(err)
+		}
+
+		for _, d := range differences {
+			fmt.Println(d)
+		}
+		cleanup()
+
+		if len(differences) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	var only *ExportedImage
+	if flags.NArg() > 0 {
+		only, err = export.Select(flags.Arg(0))
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	fi := FileIndex{}
+	for _, entry := range export.Chain() {
+		entries, err := readLayerEntries(entry.LayerTarPath, false)
+		if err != nil {
+			fatal(err)
+		}
+		changes := fi.apply(entry.LayerConfig.Id, entries)
+
+		if only != nil && only != entry {
+			continue
+		}
+
+		cmd := strings.Join(entry.LayerConfig.ContainerConfig().Cmd, " ")
+		if len(cmd) > 60 {
+			cmd = cmd[0:57] + "..."
+		}
+		fmt.Println(entry.LayerConfig.Id[0:12], cmd)
+		for _, c := range changes {
+			fmt.Printf("  %s %s %s\n", c.Kind, c.Path, units.HumanSize(float64(c.Size)))
+		}
+	}
+
+	cleanup()
+}
+
+// compareExports replays the layers of both exports and describes every
+// path that differs between the resulting filesystems.  Paths matching one
+// of the exclude patterns, or below a directory that does, are ignored.
+func compareExports(a, b *Export, excludes []string) ([]string, error) {
+	ai, err := a.FileIndex(true)
+	if err != nil {
+		return nil, err
+	}
+
+	bi, err := b.FileIndex(true)
+	if err != nil {
+		return nil, err
+	}
+
+	return compareIndexes(ai, bi, excludes), nil
+}
+
+func compareIndexes(a, b FileIndex, excludes []string) []string {
+	paths := map[string]bool{}
+	for p := range a {
+		paths[p] = true
+	}
+	for p := range b {
+		paths[p] = true
+	}
+
+	sorted := []string{}
+	for p := range paths {
+		if !excluded(p, excludes) {
+			sorted = append(sorted, p)
+		}
+	}
+	sort.Strings(sorted)
+
+	differences := []string{}
+	for _, p := range sorted {
+		ae, be := a[p], b[p]
+		switch {
+		case be == nil:
+			differences = append(differences, fmt.Sprintf("- %s", p))
+		case ae == nil:
+			differences = append(differences, fmt.Sprintf("+ %s", p))
+		default:
+			for _, d := range compareEntries(ae, be) {
+				differences = append(differences, fmt.Sprintf("~ %s: %s", p, d))
+			}
+		}
+	}
+	return differences
+}
+
+func compareEntries(a, b *FileEntry) []string {
+	a, b = a.content(), b.content()
+	ah, bh := a.Header, b.Header
+	differences := []string{}
+	if ah.Typeflag != bh.Typeflag {
+		differences = append(differences, fmt.Sprintf("type %c != %c", ah.Typeflag, bh.Typeflag))
+	}
+	if ah.Mode != bh.Mode {
+		differences = append(differences, fmt.Sprintf("mode %o != %o", ah.Mode, bh.Mode))
+	}
+	if ah.Uid != bh.Uid || ah.Gid != bh.Gid {
+		differences = append(differences, fmt.Sprintf("owner %d:%d != %d:%d", ah.Uid, ah.Gid, bh.Uid, bh.Gid))
+	}
+	if ah.Linkname != bh.Linkname && ah.Typeflag == tar.TypeSymlink {
+		differences = append(differences, fmt.Sprintf("link %s != %s", ah.Linkname, bh.Linkname))
+	}
+	if isDevice(ah) && (ah.Devmajor != bh.Devmajor || ah.Devminor != bh.Devminor) {
+		differences = append(differences, fmt.Sprintf("device %d,%d != %d,%d",
+			ah.Devmajor, ah.Devminor, bh.Devmajor, bh.Devminor))
+	}
+	if ax, bx := strings.Join(xattrs(ah), " "), strings.Join(xattrs(bh), " "); ax != bx {
+		differences = append(differences, fmt.Sprintf("xattrs %s != %s", ax, bx))
+	}
+	if ah.Size != bh.Size {
+		differences = append(differences, fmt.Sprintf("size %d != %d", ah.Size, bh.Size))
+	} else if a.Digest != b.Digest {
+		differences = append(differences, "content differs")
+	}
+	return differences
+}
+
+// excluded returns true if p, or one of its parent directories, matches
+// one of the patterns.
+func excluded(p string, patterns []string) bool {
+	for _, pattern := range patterns {
+		for c := p; ; c = path.Dir(c) {
+			if matched, _ := path.Match(pattern, c); matched {
+				return true
+			}
+			if c == "/" {
+				break
+			}
+		}
+	}
+	return false
+}
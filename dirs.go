@@ -0,0 +1,54 @@
+package main
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// applyDirMetadata gives each dir of the squashed layer dir the mode, owner,
+// mtime and extended attributes of the dir in the topmost squashed layer
+// that has it, as overlay filesystems do.  Extracting the layers one after
+// the other, whiteouts and -dedupe otherwise leave dirs with mtimes of the
+// squash and extended attributes of lower layers.
+func (e *ExportedImage) applyDirMetadata() error {
+	for p, fe := range e.merged {
+		h := fe.Header
+		if h.Typeflag != tar.TypeDir {
+			continue
+		}
+
+		fn := filepath.Join(e.LayerDirPath, p)
+		fi, err := os.Lstat(fn)
+		if err != nil || !fi.IsDir() {
+			continue
+		}
+
+		if err := os.Lchown(fn, h.Uid, h.Gid); err != nil {
+			return err
+		}
+		mode := h.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		if err := os.Chmod(fn, mode); err != nil {
+			return err
+		}
+		if err := setXattrs(fn, xattrRecords(h)); err != nil {
+			return err
+		}
+		if err := os.Chtimes(fn, h.ModTime, h.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// xattrRecords returns the extended attributes of a tar entry by name.
+func xattrRecords(h *tar.Header) map[string]string {
+	attrs := map[string]string{}
+	for k, v := range h.PAXRecords {
+		if strings.HasPrefix(k, paxXattr) {
+			attrs[strings.TrimPrefix(k, paxXattr)] = v
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSquashDirMetadata(t *testing.T) {
+	requireSquash(t)
+
+	dir := func(name string, mode int64, uid, gid int, mtime int64, attrs map[string]string) testEntry {
+		te := dirEntry(name, mode)
+		te.header.Uid, te.header.Gid = uid, gid
+		te.header.ModTime = time.Unix(mtime, 0)
+		te.header.PAXRecords = map[string]string{}
+		for k, v := range attrs {
+			te.header.PAXRecords[paxXattr+k] = v
+		}
+		return te
+	}
+
+	export := testExport(t,
+		[]testEntry{dir("tmp/", 0755, 0, 0, 1400000000, nil), dir("srv/", 0755, 0, 0, 1400000000, nil)},
+		[]testEntry{
+			dir("tmp/", 0700, 10, 10, 1500000000, map[string]string{"user.lower": "1"}),
+			dir("srv/", 0700, 1000, 1000, 1500000000, map[string]string{"user.lower": "1"}),
+			fileEntry("srv/data", "data"),
+		},
+		[]testEntry{
+			dir("tmp/", 01777, 0, 0, 1600000000, map[string]string{"user.upper": "2"}),
+			dir("srv/", 02750, 2000, 3000, 1600000000, map[string]string{"trusted.upper": "2"}),
+		},
+		// writes into the dirs without entries for them
+		[]testEntry{fileEntry("tmp/file", "file"), fileEntry("srv/.wh.data", "")},
+	)
+	_, headers := squashTestExport(t, export)
+
+	want := map[string]struct {
+		mode     int64
+		uid, gid int
+		attrs    []string
+	}{
+		"./tmp/": {01777, 0, 0, []string{`user.upper="2"`}},
+		"./srv/": {02750, 2000, 3000, []string{`trusted.upper="2"`}},
+	}
+	for name, w := range want {
+		h := headers[name]
+		if h == nil {
+			t.Errorf("%s is missing", name)
+			continue
+		}
+		if h.Typeflag != tar.TypeDir {
+			t.Errorf("%s has type %c, want a dir", name, h.Typeflag)
+		}
+		if mode := h.Mode & 07777; mode != w.mode {
+			t.Errorf("%s has mode %o, want %o", name, mode, w.mode)
+		}
+		if h.Uid != w.uid || h.Gid != w.gid {
+			t.Errorf("%s is owned by %d:%d, want %d:%d", name, h.Uid, h.Gid, w.uid, w.gid)
+		}
+		if !h.ModTime.Equal(time.Unix(1600000000, 0)) {
+			t.Errorf("%s has mtime %s, want %s", name, h.ModTime.UTC(), time.Unix(1600000000, 0).UTC())
+		}
+		if got := xattrs(h); fmt.Sprint(got) != fmt.Sprint(w.attrs) {
+			t.Errorf("%s has xattrs %v, want %v", name, got, w.attrs)
+		}
+	}
+
+	for _, root := range []string{"./", ".", "/"} {
+		if headers[root] != nil {
+			t.Errorf("squashed layer has a root entry %q", root)
+		}
+	}
+}
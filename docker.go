@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const defaultDockerHost = "unix:///var/run/docker.sock"
+
+// DockerClient talks to the Docker Engine API.
+type DockerClient struct {
+	client *http.Client
+	base   string
+}
+
+// NewDockerClient returns a client for the daemon at host, a unix:// or
+// tcp:// address.  An empty host uses DOCKER_HOST, or the default socket.
+func NewDockerClient(host string) (*DockerClient, error) {
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		host = defaultDockerHost
+	}
+
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport := &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		}
+		return &DockerClient{
+			client: &http.Client{Transport: transport},
+			base:   "http://docker",
+		}, nil
+	case "tcp", "http":
+		return &DockerClient{
+			client: &http.Client{},
+			base:   "http://" + u.Host,
+		}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unsupported docker host %s", host))
+}
+
+// SaveImage returns the tar archive of an image, as created by docker save.
+func (c *DockerClient) SaveImage(name string) (io.ReadCloser, error) {
+	path := (&url.URL{Path: "/images/" + name + "/get"}).EscapedPath()
+	resp, err := c.client.Get(c.base + path)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return resp.Body, nil
+}
+
+// LoadImage streams a tar archive from r to the daemon, as docker load
+// does, and returns the loaded image IDs and tags.
+func (c *DockerClient) LoadImage(r io.Reader) ([]string, error) {
+	resp, err := c.client.Post(c.base+"/images/load", "application/x-tar", r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+
+	loaded := []string{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		msg := struct {
+			Stream string `json:"stream"`
+			Error  string `json:"error"`
+		}{}
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			continue
+		}
+
+		if msg.Error != "" {
+			return nil, errors.New(msg.Error)
+		}
+
+		for _, prefix := range []string{"Loaded image ID: ", "Loaded image: "} {
+			if strings.HasPrefix(msg.Stream, prefix) {
+				loaded = append(loaded, strings.TrimSpace(msg.Stream[len(prefix):]))
+			}
+		}
+	}
+	return loaded, scanner.Err()
+}
+
+func responseError(resp *http.Response) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	msg := struct {
+		Message string `json:"message"`
+	}{}
+	if err := json.Unmarshal(body, &msg); err == nil && msg.Message != "" {
+		return errors.New(msg.Message)
+	}
+	return errors.New(fmt.Sprintf("%s: %s", resp.Status, strings.TrimSpace(string(body))))
+}
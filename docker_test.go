@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeDaemon serves handler on a unix socket and returns a client for it.
+func fakeDaemon(t *testing.T, handler http.Handler) *DockerClient {
+	dir, err := ioutil.TempDir("", "docker-squash-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(dir, "docker.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+		os.RemoveAll(dir)
+	})
+	go http.Serve(l, handler)
+
+	c, err := NewDockerClient("unix://" + sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestSaveImage(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/images/foo:bar/get", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("archive"))
+	})
+	c := fakeDaemon(t, mux)
+
+	r, err := c.SaveImage("foo:bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "archive" {
+		t.Errorf("got %q, want %q", b, "archive")
+	}
+}
+
+func TestLoadImage(t *testing.T) {
+	var body []byte
+	mux := http.NewServeMux()
+	mux.HandleFunc("/images/load", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			t.Errorf("got method %s, want POST", r.Method)
+		}
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Write([]byte(`{"stream":"Loaded image: foo:squashed\n"}` + "\n" +
+			`not json` + "\n" +
+			`{"stream":"Loaded image ID: sha256:abc\n"}` + "\n"))
+	})
+	c := fakeDaemon(t, mux)
+
+	loaded, err := c.LoadImage(bytes.NewBufferString("archive"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "archive" {
+		t.Errorf("daemon got %q, want %q", body, "archive")
+	}
+	if len(loaded) != 2 || loaded[0] != "foo:squashed" || loaded[1] != "sha256:abc" {
+		t.Errorf("got %v, want [foo:squashed sha256:abc]", loaded)
+	}
+}
+
+func TestLoadImageStreamError(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/images/load", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"error":"invalid archive"}` + "\n"))
+	})
+	c := fakeDaemon(t, mux)
+
+	_, err := c.LoadImage(bytes.NewBufferString("archive"))
+	if err == nil || err.Error() != "invalid archive" {
+		t.Errorf("got error %v, want invalid archive", err)
+	}
+}
+
+func TestResponseError(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/images/missing/get", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message":"No such image: missing"}`))
+	})
+	mux.HandleFunc("/images/load", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("daemon failed\n"))
+	})
+	c := fakeDaemon(t, mux)
+
+	_, err := c.SaveImage("missing")
+	if err == nil || err.Error() != "No such image: missing" {
+		t.Errorf("got error %v, want the message of the response", err)
+	}
+
+	_, err = c.LoadImage(bytes.NewBufferString("archive"))
+	if want := "500 Internal Server Error: daemon failed"; err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %s", err, want)
+	}
+}
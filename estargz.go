@@ -0,0 +1,425 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	estargzTOCName          = "stargz.index.json"
+	estargzPrefetch         = ".prefetch.landmark"
+	estargzNoPrefetch       = ".no.prefetch.landmark"
+	estargzChunkSize        = 4 << 20
+	estargzTOCDigest        = "containerd.io/snapshot/stargz/toc.digest"
+	estargzUncompressedSize = "io.containers.estargz.uncompressed-size"
+)
+
+// estargzTOC is the table of contents stored at the end of an eStargz
+// layer.
+type estargzTOC struct {
+	Version int             `json:"version"`
+	Entries []*estargzEntry `json:"entries"`
+}
+
+type estargzEntry struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Size        int64             `json:"size,omitempty"`
+	ModTime     string            `json:"modtime,omitempty"`
+	LinkName    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	Uid         int               `json:"uid,omitempty"`
+	Gid         int               `json:"gid,omitempty"`
+	Uname       string            `json:"userName,omitempty"`
+	Gname       string            `json:"groupName,omitempty"`
+	DevMajor    int64             `json:"devMajor,omitempty"`
+	DevMinor    int64             `json:"devMinor,omitempty"`
+	Xattrs      map[string]string `json:"xattrs,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	ChunkOffset int64             `json:"chunkOffset,omitempty"`
+	ChunkSize   int64             `json:"chunkSize,omitempty"`
+	ChunkDigest string            `json:"chunkDigest,omitempty"`
+}
+
+var estargzTypes = map[byte]string{
+	tar.TypeReg:     "reg",
+	tar.TypeRegA:    "reg",
+	tar.TypeDir:     "dir",
+	tar.TypeSymlink: "symlink",
+	tar.TypeLink:    "hardlink",
+	tar.TypeChar:    "char",
+	tar.TypeBlock:   "block",
+	tar.TypeFifo:    "fifo",
+}
+
+// ReadPriorityFiles reads the paths to prefetch first from an eStargz layer,
+// one per line, in the order they are accessed.
+func ReadPriorityFiles(file string) ([]string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, cleanPath(line))
+	}
+	return paths, nil
+}
+
+// ConvertEstargz rewrites the layer tar as an eStargz layer: a gzip stream
+// with one member per entry, or per chunk of a large file, followed by a
+// table of contents and a footer pointing to it.  The files in priority come
+// first, followed by a landmark file, so they can be prefetched.  The
+// annotations of the layer descriptor are set in e.Annotations.
+func (e *ExportedImage) ConvertEstargz(priority []string) error {
+	debugf("  -  Converting %s to eStargz\n", e.LayerConfig.Id[:12])
+
+	tmp := e.LayerTarPath + ".stargz"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	w := newEstargzWriter(out)
+	if err := w.writeLayer(e.LayerTarPath, priority, e.Path); err != nil {
+		return err
+	}
+	tocDigest, err := w.close()
+	if err != nil {
+		return err
+	}
+
+	e.diffId = hashDigest(w.digest)
+	e.Annotations = map[string]string{
+		estargzTOCDigest:        tocDigest,
+		estargzUncompressedSize: strconv.FormatInt(w.uncompressed.n, 10),
+	}
+	return os.Rename(tmp, e.LayerTarPath)
+}
+
+type estargzWriter struct {
+	compressed   *countingWriter
+	uncompressed *countingWriter
+	digest       hash.Hash
+	gz           *gzip.Writer
+	tw           *tar.Writer
+	toc          *estargzTOC
+	written      map[string]bool
+}
+
+func newEstargzWriter(w io.Writer) *estargzWriter {
+	e := &estargzWriter{
+		compressed: &countingWriter{w: w},
+		toc:        &estargzTOC{Version: 1},
+		written:    map[string]bool{},
+		digest:     sha256.New(),
+	}
+	e.uncompressed = &countingWriter{w: io.MultiWriter(e.digest, writerFunc(func(p []byte) (int, error) {
+		return e.gz.Write(p)
+	}))}
+	e.tw = tar.NewWriter(e.uncompressed)
+	return e
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// startMember closes the current gzip member and starts a new one at the
+// current offset of the compressed stream.
+func (e *estargzWriter) startMember() error {
+	if err := e.endMember(); err != nil {
+		return err
+	}
+	e.gz = gzip.NewWriter(e.compressed)
+	return nil
+}
+
+func (e *estargzWriter) endMember() error {
+	if e.gz == nil {
+		return nil
+	}
+	err := e.gz.Close()
+	e.gz = nil
+	return err
+}
+
+// writeLayer copies the entries of the layer tar at p, writing the entries
+// in priority first.  Their content is kept in files under tmpdir until
+// they are written.
+func (e *estargzWriter) writeLayer(p string, priority []string, tmpdir string) error {
+	headers := map[string]*tar.Header{}
+	content := map[string]string{}
+	wanted := map[string]bool{}
+	for _, p := range priority {
+		wanted[p] = true
+	}
+
+	// Keep the headers of every entry, as the parent dirs of the priority
+	// files are written before them, and the content of the priority files.
+	err := e.eachEntry(p, func(h *tar.Header, r io.Reader) error {
+		name := cleanPath(h.Name)
+		headers[name] = h
+		if !wanted[name] || !isRegular(h) {
+			return nil
+		}
+
+		f, err := ioutil.TempFile(tmpdir, "prefetch")
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		content[name] = f.Name()
+		_, err = io.Copy(f, r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range content {
+			os.Remove(f)
+		}
+	}()
+
+	prefetched := 0
+	for _, name := range priority {
+		h, ok := headers[name]
+		if !ok || h.Typeflag == tar.TypeLink {
+			debugf("  -  %s is not a file in the layer. Not prefetching it.\n", name)
+			continue
+		}
+
+		for _, dir := range parentDirs(name) {
+			if dh, ok := headers[dir]; ok && !e.written[dir] {
+				if err := e.writeEntry(dh, nil); err != nil {
+					return err
+				}
+			}
+		}
+		if e.written[name] {
+			continue
+		}
+
+		var r io.Reader
+		if f, ok := content[name]; ok {
+			file, err := os.Open(f)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			r = file
+		}
+		if err := e.writeEntry(h, r); err != nil {
+			return err
+		}
+		prefetched++
+	}
+
+	landmark := estargzNoPrefetch
+	if prefetched > 0 {
+		landmark = estargzPrefetch
+	}
+	err = e.writeEntry(&tar.Header{
+		Name:     landmark,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     1,
+	}, strings.NewReader("\x0f"))
+	if err != nil {
+		return err
+	}
+
+	return e.eachEntry(p, func(h *tar.Header, r io.Reader) error {
+		if e.written[cleanPath(h.Name)] {
+			return nil
+		}
+		return e.writeEntry(h, r)
+	})
+}
+
+func (e *estargzWriter) eachEntry(p string, fn func(*tar.Header, io.Reader) error) error {
+	f, err := openLayerTar(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	t := tar.NewReader(f)
+	for {
+		header, err := t.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := fn(header, t); err != nil {
+			return err
+		}
+	}
+}
+
+// writeEntry writes an entry in a new gzip member.  Regular files larger
+// than estargzChunkSize are split into chunks, each in its own member.
+func (e *estargzWriter) writeEntry(h *tar.Header, r io.Reader) error {
+	name := cleanPath(h.Name)
+	e.written[name] = true
+
+	if err := e.startMember(); err != nil {
+		return err
+	}
+	offset := e.compressed.n
+	entry := &estargzEntry{
+		Name:     strings.TrimPrefix(name, "/"),
+		Type:     estargzTypes[h.Typeflag],
+		ModTime:  h.ModTime.UTC().Format(time.RFC3339),
+		LinkName: h.Linkname,
+		Mode:     h.Mode,
+		Uid:      h.Uid,
+		Gid:      h.Gid,
+		Uname:    h.Uname,
+		Gname:    h.Gname,
+		DevMajor: h.Devmajor,
+		DevMinor: h.Devminor,
+	}
+	if len(h.Xattrs) > 0 {
+		entry.Xattrs = map[string]string{}
+		for k, v := range h.Xattrs {
+			entry.Xattrs[k] = base64.StdEncoding.EncodeToString([]byte(v))
+		}
+	}
+	if entry.Type == "hardlink" {
+		entry.LinkName = strings.TrimPrefix(cleanPath(h.Linkname), "/")
+	}
+
+	if err := e.tw.WriteHeader(h); err != nil {
+		return err
+	}
+
+	if entry.Type != "reg" {
+		if name != "/" && entry.Type != "" {
+			e.toc.Entries = append(e.toc.Entries, entry)
+		}
+		return e.tw.Flush()
+	}
+
+	entry.Size = h.Size
+	entry.Offset = offset
+	e.toc.Entries = append(e.toc.Entries, entry)
+
+	file := sha256.New()
+	for off := int64(0); off < h.Size || off == 0; off += estargzChunkSize {
+		size := h.Size - off
+		if size > estargzChunkSize {
+			size = estargzChunkSize
+		}
+
+		chunk := entry
+		if off > 0 {
+			if err := e.startMember(); err != nil {
+				return err
+			}
+			chunk = &estargzEntry{Name: entry.Name, Type: "chunk", Offset: e.compressed.n, ChunkOffset: off}
+			e.toc.Entries = append(e.toc.Entries, chunk)
+		}
+		if h.Size > estargzChunkSize {
+			chunk.ChunkSize = size
+		}
+
+		h := sha256.New()
+		if size > 0 {
+			if _, err := io.CopyN(io.MultiWriter(e.tw, file, h), r, size); err != nil {
+				return err
+			}
+		}
+		chunk.ChunkDigest = hashDigest(h)
+		if size == 0 {
+			break
+		}
+	}
+	entry.Digest = hashDigest(file)
+	return e.tw.Flush()
+}
+
+// close writes the table of contents and the footer, and returns the digest
+// of the table of contents.
+func (e *estargzWriter) close() (string, error) {
+	tocJson, err := json.Marshal(e.toc)
+	if err != nil {
+		return "", err
+	}
+
+	if err := e.startMember(); err != nil {
+		return "", err
+	}
+	tocOffset := e.compressed.n
+	err = e.tw.WriteHeader(&tar.Header{
+		Name:     estargzTOCName,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(tocJson)),
+	})
+	if err != nil {
+		return "", err
+	}
+	if _, err := e.tw.Write(tocJson); err != nil {
+		return "", err
+	}
+	if err := e.tw.Close(); err != nil {
+		return "", err
+	}
+	if err := e.endMember(); err != nil {
+		return "", err
+	}
+
+	if _, err := e.compressed.Write(estargzFooter(tocOffset)); err != nil {
+		return "", err
+	}
+	return digestOf(tocJson), nil
+}
+
+// estargzFooter returns an empty gzip member whose extra field holds the
+// offset of the table of contents.  It's written by hand as the empty
+// deflate block must be a stored block for the footer to be 51 bytes.
+func estargzFooter(tocOffset int64) []byte {
+	subfield := fmt.Sprintf("%016xSTARGZ", tocOffset)
+	extra := []byte{'S', 'G', 0, 0}
+	binary.LittleEndian.PutUint16(extra[2:], uint16(len(subfield)))
+	extra = append(extra, subfield...)
+
+	footer := []byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff, 0, 0}
+	binary.LittleEndian.PutUint16(footer[10:], uint16(len(extra)))
+	footer = append(footer, extra...)
+	footer = append(footer, 1, 0, 0, 0xff, 0xff)
+	return append(footer, make([]byte, 8)...)
+}
+
+// parentDirs returns the parent dirs of a cleaned path, from the root.
+func parentDirs(p string) []string {
+	dirs := []string{}
+	for d := path.Dir(p); d != "/" && d != "."; d = path.Dir(d) {
+		dirs = append([]string{d}, dirs...)
+	}
+	return dirs
+}
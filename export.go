@@ -7,13 +7,13 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/docker/docker/pkg/units"
@@ -108,6 +108,7 @@ type LayerConfig struct {
 	Config            *Config          `json:"config,omitempty"`
 	DockerVersion     string           `json:"docker_version"`
 	Architecture      string           `json:"architecture"`
+	DiffId            string           `json:"diff_id,omitempty"` // of layers written by docker-squash
 }
 
 func (l *LayerConfig) ContainerConfig() *ContainerConfig {
@@ -136,12 +137,6 @@ func LoadExport(image, location string) (*Export, error) {
 		debugf("Loading export from %s using %s for tempdir\n", image, location)
 	}
 
-	export := &Export{
-		Entries:      map[string]*ExportedImage{},
-		Repositories: map[string]*TagInfo{},
-		Path:         location,
-	}
-
 	ir := os.Stdin
 	if image != "" {
 		var err error
@@ -149,9 +144,36 @@ func LoadExport(image, location string) (*Export, error) {
 		if err != nil {
 			return nil, err
 		}
+		defer ir.Close()
+
+		size, err := declaredSize(ir)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkFreeSpace(filepath.Dir(location), size); err != nil {
+			return nil, err
+		}
+	}
+
+	return ReadExport(ir, location)
+}
+
+// ReadExport loads a tarball export created by docker save from r, which
+// may be compressed.
+func ReadExport(r io.Reader, location string) (*Export, error) {
+	export := &Export{
+		Entries:      map[string]*ExportedImage{},
+		Repositories: map[string]*TagInfo{},
+		Path:         location,
 	}
 
-	err := export.Extract(ir)
+	dr, err := decompressStream(r)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+
+	err = export.Extract(dr)
 	if err != nil {
 		return nil, err
 	}
@@ -163,7 +185,7 @@ func LoadExport(image, location string) (*Export, error) {
 
 	for _, dir := range dirs {
 
-		if !dir.IsDir() {
+		if !dir.IsDir() || !isLayerDir(filepath.Join(export.Path, dir.Name())) {
 			continue
 		}
 
@@ -179,6 +201,9 @@ func LoadExport(image, location string) (*Export, error) {
 		if err != nil {
 			return nil, err
 		}
+		if entry.LayerConfig == nil {
+			return nil, &IntegrityError{Kind: MissingJson, Layer: dir.Name(), Detail: "it has no layer json"}
+		}
 
 		export.Entries[entry.LayerConfig.Id] = entry
 	}
@@ -188,6 +213,16 @@ func LoadExport(image, location string) (*Export, error) {
 		return nil, err
 	}
 
+	err = export.checkLayerCount()
+	if err != nil {
+		return nil, err
+	}
+
+	err = export.Check()
+	if err != nil {
+		return nil, err
+	}
+
 	debugf("Loaded image w/ %s layers\n", strconv.FormatInt(int64(len(export.Entries)), 10))
 	for repo, tags := range export.Repositories {
 		debugf("  -  %s (%s tags)\n", repo, strconv.FormatInt(int64(len(*tags)), 10))
@@ -195,6 +230,17 @@ func LoadExport(image, location string) (*Export, error) {
 	return export, err
 }
 
+// isLayerDir returns whether a dir of the export holds a layer rather than,
+// say, the blobs of an OCI layout.
+func isLayerDir(p string) bool {
+	for _, name := range []string{"json", "VERSION", "layer.tar"} {
+		if _, err := os.Lstat(filepath.Join(p, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
 func (e *Export) Extract(r io.Reader) error {
 
 	err := os.MkdirAll(e.Path, 0755)
@@ -202,20 +248,54 @@ func (e *Export) Extract(r io.Reader) error {
 		return err
 	}
 
+	counter := &limitCounter{}
+	links := map[string]string{}
 	t := tar.NewReader(r)
 	for {
 		header, err := t.Next()
 		if err != nil {
 			if err == io.EOF {
-				return nil
+				return e.linkFiles(links)
 			}
 			return err
 		}
 
-		if header.Name == "." || header.Name == ".." || header.Name == "./" {
+		name, err := relativeName(header.Name)
+		if err != nil {
+			return &UnsafeEntryError{Name: header.Name, Reason: err.Error()}
+		}
+		if err := counter.add(header); err != nil {
+			return err
+		}
+		if name == "." {
+			continue
+		}
+		switch header.Typeflag {
+		case tar.TypeSymlink:
+			target := path.Join(path.Dir(name), header.Linkname)
+			if path.IsAbs(header.Linkname) || target == ".." || strings.HasPrefix(target, "../") {
+				return &UnsafeEntryError{Name: header.Name,
+					Reason: fmt.Sprintf("symlink to %s is outside of the archive", header.Linkname)}
+			}
+			links[name] = target
+			continue
+		case tar.TypeLink:
+			target, err := relativeName(header.Linkname)
+			if err != nil {
+				return &UnsafeEntryError{Name: header.Name,
+					Reason: fmt.Sprintf("hard link to %s: %s", header.Linkname, err)}
+			}
+			links[name] = target
 			continue
 		}
-		fn := path.Join(e.Path, header.Name)
+		if header.Typeflag != tar.TypeDir && header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			return &UnsafeEntryError{Name: header.Name,
+				Reason: fmt.Sprintf("unsupported entry type %q", header.Typeflag)}
+		}
+		if err := checkParents(e.Path, name); err != nil {
+			return &UnsafeEntryError{Name: header.Name, Reason: err.Error()}
+		}
+		fn := filepath.Join(e.Path, name)
 
 		if header.FileInfo().IsDir() {
 			err = os.Mkdir(fn, header.FileInfo().Mode())
@@ -230,14 +310,15 @@ func (e *Export) Extract(r io.Reader) error {
 			continue
 		}
 
-		item, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY, header.FileInfo().Mode())
+		item, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|syscall.O_NOFOLLOW, header.FileInfo().Mode())
 		if err != nil {
 			return err
 		}
-		if _, err := io.Copy(item, t); err != nil {
-			log.Fatalln(err)
-		}
+		_, err = io.Copy(item, t)
 		item.Close()
+		if err != nil {
+			return err
+		}
 		err = os.Chtimes(fn, time.Now().UTC(), header.FileInfo().ModTime())
 		if err != nil {
 			return err
@@ -245,12 +326,42 @@ func (e *Export) Extract(r io.Reader) error {
 	}
 }
 
+// linkFiles creates the symlinks and hard links of the archive to its files,
+// which docker save writes for layers with the same diff_id as an earlier
+// layer, and tar for the squashed archive.  They are all created as hard
+// links so that they outlive the layer they point to when it's squashed.
+func (e *Export) linkFiles(links map[string]string) error {
+	for name, target := range links {
+		for i := 0; i < len(links) && links[target] != ""; i++ {
+			target = links[target]
+		}
+
+		if err := checkParents(e.Path, target); err != nil {
+			return &UnsafeEntryError{Name: name, Reason: err.Error()}
+		}
+		fi, err := os.Lstat(filepath.Join(e.Path, target))
+		if err != nil || !fi.Mode().IsRegular() {
+			return &UnsafeEntryError{Name: name, Reason: fmt.Sprintf("link to %s, which isn't a file of the archive", target)}
+		}
+		if err := checkParents(e.Path, name); err != nil {
+			return &UnsafeEntryError{Name: name, Reason: err.Error()}
+		}
+
+		debugf("  -  Linking %s to %s\n", name, target)
+		if err := os.Link(filepath.Join(e.Path, target), filepath.Join(e.Path, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (e *Export) ExtractLayers() error {
 	debug("Extracting layers...")
 
-	for _, entry := range e.Entries {
+	chain := e.Chain()
+	for i, entry := range chain {
 		debugf("  -  %s\n", entry.LayerTarPath)
-		err := entry.ExtractLayerDir()
+		err := entry.ExtractLayerDir(chain[:i])
 		if err != nil {
 			return err
 		}
@@ -379,7 +490,7 @@ func (e *Export) PrintHistory() {
 
 		debug("  - ", order[i].LayerConfig.Id[0:12],
 			humanDuration(time.Now().UTC().Sub(order[i].LayerConfig.Created.UTC())),
-			cmd, units.HumanSize(float64(size)))
+			cmd, units.HumanSize(float64(size)), order[i].LayerConfig.DiffId)
 	}
 }
 
@@ -399,7 +510,7 @@ func (e *Export) InsertLayer(parent string) (*ExportedImage, error) {
 		LayerDirPath: filepath.Join(e.Path, id, "layer"),
 		LayerConfig:  layerConfig,
 	}
-	entry.LayerConfig.Created = time.Now().UTC()
+	entry.LayerConfig.Created = now()
 
 	err = entry.CreateDirs()
 	if err != nil {
@@ -417,6 +528,9 @@ func (e *Export) InsertLayer(parent string) (*ExportedImage, error) {
 	}
 
 	child := e.ChildOf(parent)
+	if child == nil {
+		return nil, errors.New(fmt.Sprintf("%s has no layers above it to squash", parent[:12]))
+	}
 	child.LayerConfig.Parent = id
 
 	err = child.WriteJson()
@@ -444,7 +558,7 @@ func (e *Export) ReplaceLayer(oldId string) (*ExportedImage, error) {
 		cmd = cmd[:47] + "..."
 	}
 
-	debugf("  -  Replacing %s w/ new layer %s (%s)\n", oldId[:12], id[:12], cmd)
+	debugf("  -  Replacing %s w/ new layer %s. Metadata only. (%s)\n", oldId[:12], id[:12], cmd)
 	if child != nil {
 		child.LayerConfig.Parent = id
 		err = child.WriteJson()
@@ -470,8 +584,10 @@ func (e *Export) ReplaceLayer(oldId string) (*ExportedImage, error) {
 		LayerTarPath: filepath.Join(location, id, "layer.tar"),
 		LayerDirPath: filepath.Join(location, id, "layer"),
 		LayerConfig:  layerConfig,
+		Annotations:  orig.Annotations,
+		diffId:       orig.diffId,
 	}
-	entry.LayerConfig.Created = time.Now().UTC()
+	entry.LayerConfig.Created = now()
 
 	err = entry.WriteJson()
 	if err != nil {
@@ -494,7 +610,9 @@ func (e *Export) ReplaceLayer(oldId string) (*ExportedImage, error) {
 	return entry, err
 }
 
-func (e *Export) SquashLayers(to, from *ExportedImage) error {
+// SquashLayers merges the layers from "from" up to and including "end" into
+// the layer dir of "to".  A nil end squashes to the top of the image.
+func (e *Export) SquashLayers(to, from, end *ExportedImage) error {
 
 	debugf("Squashing from %s into %s\n", from.LayerConfig.Id[:12], to.LayerConfig.Id[:12])
 	layerDir := filepath.Join(to.Path, "layer")
@@ -508,38 +626,78 @@ func (e *Export) SquashLayers(to, from *ExportedImage) error {
 		return errors.New(fmt.Sprintf("%s does not exists", from.LayerConfig.Id))
 	}
 
+	below := []*ExportedImage{}
+	for _, entry := range e.Chain() {
+		if entry == from {
+			break
+		}
+		below = append(below, entry)
+	}
+
 	order := []*ExportedImage{}
 	for {
 		order = append(order, current)
+		if end != nil && current.LayerConfig.Id == end.LayerConfig.Id {
+			break
+		}
 		current = e.ChildOf(current.LayerConfig.Id)
 		if current == nil {
 			break
 		}
 	}
 
+	counter := &limitCounter{}
+	merged := FileIndex{}
 	for _, entry := range order {
 		if _, err := os.Stat(entry.LayerTarPath); os.IsNotExist(err) {
 			continue
 		}
 
-		out, err := extractTar(entry.LayerTarPath, layerDir)
+		entries, err := readLayerEntries(entry.LayerTarPath, false)
+		if err != nil {
+			return err
+		}
+
+		counter.layer = entry.LayerConfig.Id
+		for _, le := range entries {
+			if err := counter.add(le.Header); err != nil {
+				return err
+			}
+		}
+
+		err = confineLayer(entry.LayerConfig.Id, layerDir, entries)
+		if err != nil {
+			return err
+		}
+
+		debug("  -  Applying whiteouts for layer " + entry.LayerConfig.Id[:12])
+		err = e.applyWhiteouts(layerDir, entries)
+		if err != nil {
+			return err
+		}
+
+		err = restoreLinkTargets(below, layerDir, entries)
 		if err != nil {
-			println(string(out))
 			return err
 		}
 
-		debug("  -  Deleting whiteouts for layer " + entry.LayerConfig.Id[:12])
-		err = e.deleteWhiteouts(layerDir)
+		merged.apply(entry.LayerConfig.Id, entries)
+		out, err := extractTar(entry.LayerTarPath, layerDir, deviceNames(entries))
 		if err != nil {
+			println(string(out))
 			return err
 		}
 	}
 
+	to.merged = merged
+
 	debug("  -  Rewriting child history")
-	return e.rewriteChildren(from)
+	return e.rewriteChildren(from, end)
 }
 
-func (e *Export) TarLayers(w io.Writer) error {
+// TarLayers writes the export as a tar archive to w, leaving out the layers
+// in omit.
+func (e *Export) TarLayers(w io.Writer, omit map[string]bool) error {
 	cwd, err := os.Getwd()
 	if err != nil {
 		return err
@@ -557,7 +715,24 @@ func (e *Export) TarLayers(w io.Writer) error {
 	}
 	defer os.Chdir(cwd)
 
-	cmd := exec.Command("sudo", "/bin/sh", "-c", "tar cOf  - *")
+	files, err := ioutil.ReadDir(location)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"tar", "cOf", "-"}
+	if !sourceDate.IsZero() {
+		args = append(args, reproducibleTarArgs()...)
+		args = append(args, "--owner=0", "--group=0")
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), ".") || omit[f.Name()] {
+			continue
+		}
+		args = append(args, f.Name())
+	}
+
+	cmd := exec.Command("sudo", args...)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return err
@@ -598,9 +773,14 @@ func (e *Export) RemoveExtractedLayers() error {
 	return nil
 }
 
-func (e *Export) rewriteChildren(entry *ExportedImage) error {
+func (e *Export) rewriteChildren(entry, end *ExportedImage) error {
 
 	squashId := entry.LayerConfig.Id
+	endId := ""
+	if end != nil {
+		endId = end.LayerConfig.Id
+	}
+
 	for {
 		if entry == nil {
 			break
@@ -616,7 +796,8 @@ func (e *Export) rewriteChildren(entry *ExportedImage) error {
 			continue
 		}
 
-		if strings.Contains(cmd, "#(nop)") && !(strings.Contains(cmd, "ADD") || strings.Contains(cmd, "COPY")) {
+		last := entry.LayerConfig.Id == endId
+		if entry.MetadataOnly() {
 			newEntry, err := e.ReplaceLayer(entry.LayerConfig.Id)
 			if err != nil {
 				return err
@@ -647,36 +828,55 @@ func (e *Export) rewriteChildren(entry *ExportedImage) error {
 
 		}
 
+		if last {
+			break
+		}
 	}
 	return nil
 }
 
-func (e *Export) deleteWhiteouts(location string) error {
-	return filepath.Walk(location, func(p string, info os.FileInfo, err error) error {
-		if err != nil && !os.IsNotExist(err) {
-			return err
+// applyWhiteouts prepares the squashed layer dir at location for the
+// entries of the next layer.  Paths deleted by the layer's whiteouts are
+// removed, and whiteouts of earlier layers for paths the layer writes again
+// are dropped.  The remaining whiteouts are kept in the squashed layer so
+// that deletions of content below the squashed layers still apply.  Nothing
+// is removed through a symlinked dir.
+func (e *Export) applyWhiteouts(location string, entries []*layerEntry) error {
+	for _, le := range entries {
+		if le.Path == "/" {
+			continue
 		}
 
-		if info == nil {
-			return nil
+		target, opaque, ok := le.whiteout()
+		if !ok {
+			dir, base := path.Split(le.Path)
+			if err := removeConfined(location, path.Join(dir, whiteoutPrefix+base)); err != nil {
+				return err
+			}
+			continue
 		}
 
-		name := info.Name()
-		parent := filepath.Dir(p)
-		// if start with whiteout
-		if strings.Index(name, ".wh.") == 0 {
-			deletedFile := path.Join(parent, name[len(".wh."):len(name)])
-			// remove deleted files
-			if err := os.RemoveAll(deletedFile); err != nil {
+		if !opaque {
+			if err := removeConfined(location, target); err != nil {
 				return err
 			}
-			// remove the whiteout itself
-			if err := os.RemoveAll(p); err != nil {
+			continue
+		}
+
+		if err := checkParents(location, path.Join(target, opaqueWhiteout)); err != nil {
+			return &UnsafeEntryError{Name: le.Header.Name, Reason: err.Error()}
+		}
+		children, err := ioutil.ReadDir(filepath.Join(location, target))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, child := range children {
+			if err := removeConfined(location, path.Join(target, child.Name())); err != nil {
 				return err
 			}
 		}
-		return nil
-	})
+	}
+	return nil
 }
 
 func (e *Export) WriteRepositoriesJson() error {
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+)
+
+// testSave returns the files of a docker save archive of a two layer image,
+// with an OCI blobs dir as written by newer versions of docker, and the IDs
+// of its layers.
+func testSave(t *testing.T) (map[string]string, []string) {
+	ids := []string{
+		"1111111111111111111111111111111111111111111111111111111111111111",
+		"2222222222222222222222222222222222222222222222222222222222222222",
+	}
+	files := map[string]string{
+		"repositories":          `{"test":{"latest":"` + ids[1] + `"}}`,
+		"blobs/sha256/00000000": "blob",
+	}
+	parent := ""
+	for _, id := range ids {
+		b, err := json.Marshal(newLayerConfig(id, parent, ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[id+"/json"] = string(b)
+		files[id+"/VERSION"] = "1.0"
+		files[id+"/layer.tar"] = string(testTar(map[string]string{"etc/" + id[:4]: id}))
+		parent = id
+	}
+	return files, ids
+}
+
+// saveTar returns a tar of files with entries for their dirs, as docker
+// save writes them.
+func saveTar(files map[string]string) []byte {
+	names := []string{}
+	dirs := map[string]bool{}
+	for name := range files {
+		names = append(names, name)
+		for dir := path.Dir(name); dir != "." && !dirs[dir]; dir = path.Dir(dir) {
+			dirs[dir] = true
+			names = append(names, dir+"/")
+		}
+	}
+	sort.Strings(names)
+
+	b := &bytes.Buffer{}
+	t := tar.NewWriter(b)
+	for _, name := range names {
+		if body, ok := files[name]; ok {
+			t.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body)), Typeflag: tar.TypeReg})
+			t.Write([]byte(body))
+		} else {
+			t.WriteHeader(&tar.Header{Name: name, Mode: 0755, Typeflag: tar.TypeDir})
+		}
+	}
+	t.Close()
+	return b.Bytes()
+}
+
+func readTestExport(t *testing.T, b []byte) (*Export, error) {
+	dir, err := ioutil.TempDir("", "docker-squash-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return ReadExport(bytes.NewReader(b), dir)
+}
+
+func TestReadExport(t *testing.T) {
+	files, ids := testSave(t)
+	export, err := readTestExport(t, saveTar(files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(export.Entries) != len(ids) {
+		t.Errorf("export has %d layers, want %d", len(export.Entries), len(ids))
+	}
+	if top := export.LastChild().LayerConfig.Id; top != ids[1] {
+		t.Errorf("top layer is %s, want %s", top, ids[1])
+	}
+}
+
+func TestReadExportMissingJson(t *testing.T) {
+	files, ids := testSave(t)
+	delete(files, ids[0]+"/json")
+
+	_, err := readTestExport(t, saveTar(files))
+	ie, ok := err.(*IntegrityError)
+	if !ok || ie.Kind != MissingJson || ie.Layer != ids[0] {
+		t.Errorf("got error %v, want a missing json of %s", err, ids[0])
+	}
+}
+
+func TestReadExportTruncated(t *testing.T) {
+	files, _ := testSave(t)
+	b := saveTar(files)
+
+	if _, err := readTestExport(t, b[:len(b)/2]); err == nil {
+		t.Error("truncated archive was read")
+	}
+}
+
+func TestIntegrityKindString(t *testing.T) {
+	if s := DiffIdMismatch.String(); s != "diff_id mismatch" {
+		t.Errorf("DiffIdMismatch is %q", s)
+	}
+	if s := IntegrityKind(100).String(); s != "IntegrityKind(100)" {
+		t.Errorf("unknown kind is %q", s)
+	}
+}
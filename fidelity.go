@@ -0,0 +1,167 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// isDevice returns true for character and block device entries, which
+// can't be created on disk without privileges.
+func isDevice(h *tar.Header) bool {
+	return h.Typeflag == tar.TypeChar || h.Typeflag == tar.TypeBlock
+}
+
+// isSpecial returns true for device and FIFO entries.
+func isSpecial(h *tar.Header) bool {
+	return isDevice(h) || h.Typeflag == tar.TypeFifo
+}
+
+// selinuxXattr is the SELinux label, which SELinux hosts put on every
+// extracted file.
+const selinuxXattr = "security.selinux"
+
+// hasSELinuxLabels returns true if an entry of the squashed layers has an
+// SELinux label.  Otherwise the labels of the extracted files come from the
+// host and are left out of the layer tar.
+func (e *ExportedImage) hasSELinuxLabels() bool {
+	for _, fe := range e.merged {
+		if _, ok := fe.Header.PAXRecords[paxXattr+selinuxXattr]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceNames returns the names of the device entries of a layer, which are
+// left out when extracting it and written back from their headers instead.
+func deviceNames(entries []*layerEntry) []string {
+	names := []string{}
+	for _, le := range entries {
+		if isDevice(le.Header) {
+			names = append(names, le.Header.Name)
+		}
+	}
+	return names
+}
+
+// appendDevices appends the devices of the squashed layers to the layer
+// tar, from their headers.
+func (e *ExportedImage) appendDevices() error {
+	paths := []string{}
+	for p, fe := range e.merged {
+		if isDevice(fe.Header) {
+			paths = append(paths, p)
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	sort.Strings(paths)
+
+	f, err := ioutil.TempFile(e.Path, "devices")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	for _, p := range paths {
+		h := *e.merged[p].Header
+		h.Name = "." + p
+		h.ModTime = h.ModTime.Truncate(time.Second)
+		h.AccessTime, h.ChangeTime = time.Time{}, time.Time{}
+		if !sourceDate.IsZero() {
+			if h.ModTime.After(sourceDate) {
+				h.ModTime = sourceDate
+			}
+			h.Uname, h.Gname = "", ""
+		}
+		h.Xattrs = nil
+		h.PAXRecords = map[string]string{}
+		for k, v := range e.merged[p].Header.PAXRecords {
+			if strings.HasPrefix(k, paxXattr) {
+				h.PAXRecords[k] = v
+			}
+		}
+		if err := tw.WriteHeader(&h); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	debugf("  -  Appending %d devices\n", len(paths))
+	out, err := exec.Command(TarCmd, "-Af", e.LayerTarPath, f.Name()).CombinedOutput()
+	if err != nil {
+		println(string(out))
+		return err
+	}
+
+	e.diffId = ""
+	_, err = e.DiffId()
+	return err
+}
+
+// checkFidelity checks that the layer tar kept the extended attributes,
+// devices and FIFOs of the squashed layers.  Extended attributes outside of
+// the user namespace, such as security.capability, are lost when they can't
+// be set on the extracted files.
+func (e *ExportedImage) checkFidelity() error {
+	entries, err := readLayerEntries(e.LayerTarPath, false)
+	if err != nil {
+		return err
+	}
+	written := FileIndex{}
+	written.apply(e.LayerConfig.Id, entries)
+
+	paths := []string{}
+	for p := range e.merged {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		fe := e.merged[p]
+		if fe.Header.Typeflag == tar.TypeLink && fe.Group == nil {
+			// linked to a file below the squashed layers
+			continue
+		}
+
+		want := fe.content().Header
+		out := written[p]
+		if out == nil {
+			if isSpecial(want) {
+				return fidelityError(fe, "missing from the squashed layer")
+			}
+			continue
+		}
+
+		got := out.content().Header
+		if w, g := strings.Join(xattrs(want), " "), strings.Join(xattrs(got), " "); w != g {
+			return fidelityError(fe, fmt.Sprintf("extended attributes %s were written as %s. "+
+				"Setting attributes outside of the user namespace needs root", w, g))
+		}
+		if isSpecial(want) && (want.Typeflag != got.Typeflag ||
+			want.Devmajor != got.Devmajor || want.Devminor != got.Devminor) {
+			return fidelityError(fe, fmt.Sprintf("type %c %d,%d was written as %c %d,%d",
+				want.Typeflag, want.Devmajor, want.Devminor, got.Typeflag, got.Devmajor, got.Devminor))
+		}
+	}
+	return nil
+}
+
+func fidelityError(fe *FileEntry, detail string) error {
+	return errors.New(fmt.Sprintf("layer %s: entry %s: %s", truncateID(fe.Layer), fe.Path, detail))
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testEntry is an entry of a synthetic layer tar.
+type testEntry struct {
+	header *tar.Header
+	body   string
+}
+
+func dirEntry(name string, mode int64) testEntry {
+	return testEntry{header: &tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: mode,
+		ModTime: time.Unix(1500000000, 0)}}
+}
+
+func fileEntry(name, body string) testEntry {
+	return testEntry{header: &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644,
+		Size: int64(len(body)), ModTime: time.Unix(1500000000, 0)}, body: body}
+}
+
+// requireSquash skips tests squashing layers when they can't run tar as
+// root, which extracts files with their owners and attributes.
+func requireSquash(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("squashing layers needs root")
+	}
+	for _, cmd := range []string{"sudo", TarCmd} {
+		if _, err := exec.LookPath(cmd); err != nil {
+			t.Skipf("squashing layers needs %s", cmd)
+		}
+	}
+}
+
+// testExport writes an export with a layer for each list of entries, from
+// the root.
+func testExport(t *testing.T, layers ...[]testEntry) *Export {
+	dir, err := ioutil.TempDir("", "docker-squash-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	export := &Export{
+		Entries:      map[string]*ExportedImage{},
+		Repositories: map[string]*TagInfo{},
+		Path:         dir,
+	}
+	parent := ""
+	for i, entries := range layers {
+		b := &bytes.Buffer{}
+		tw := tar.NewWriter(b)
+		for _, te := range entries {
+			if err := tw.WriteHeader(te.header); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write([]byte(te.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		addTestLayer(t, export, parent, fmt.Sprintf("/bin/sh -c step%d", i), b.Bytes())
+		parent = export.LastChild().LayerConfig.Id
+	}
+	return export
+}
+
+// addTestLayer adds a layer with the layer tar b on top of parent.
+func addTestLayer(t *testing.T, export *Export, parent, cmd string, b []byte) {
+	sum := sha256.Sum256([]byte(parent + " " + cmd))
+	id := hex.EncodeToString(sum[:])
+	entry := &ExportedImage{
+		Path:         filepath.Join(export.Path, id),
+		JsonPath:     filepath.Join(export.Path, id, "json"),
+		VersionPath:  filepath.Join(export.Path, id, "VERSION"),
+		LayerTarPath: filepath.Join(export.Path, id, "layer.tar"),
+		LayerDirPath: filepath.Join(export.Path, id, "layer"),
+		LayerConfig:  newLayerConfig(id, parent, ""),
+	}
+	entry.LayerConfig.ContainerConfig().Cmd = []string{cmd}
+	if err := entry.CreateDirs(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(entry.LayerTarPath, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := entry.WriteJson(); err != nil {
+		t.Fatal(err)
+	}
+	export.Entries[id] = entry
+}
+
+// squashTestExport squashes the layers above the root of the export and
+// returns the squashed layer and the headers of its layer tar by name.
+func squashTestExport(t *testing.T, export *Export) (*ExportedImage, map[string]*tar.Header) {
+	squashed, err := export.InsertLayer(export.Root().LayerConfig.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := export.SquashLayers(squashed, squashed, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := squashed.TarLayer(); err != nil {
+		t.Fatal(err)
+	}
+	return squashed, readTestHeaders(t, squashed.LayerTarPath)
+}
+
+// readTestHeaders returns the headers of a tar archive by name.
+func readTestHeaders(t *testing.T, p string) map[string]*tar.Header {
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	headers := map[string]*tar.Header{}
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return headers
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers[h.Name] = h
+	}
+}
+
+func TestSquashKeepsXattrs(t *testing.T) {
+	requireSquash(t)
+
+	xattrFile := func(name string, attrs map[string]string) testEntry {
+		te := fileEntry(name, "content of "+name)
+		te.header.PAXRecords = map[string]string{}
+		for k, v := range attrs {
+			te.header.PAXRecords[paxXattr+k] = v
+		}
+		return te
+	}
+
+	// cap_net_raw+ep, as set on ping
+	capability := "\x01\x00\x00\x02\x00\x20\x00\x00" + string(make([]byte, 12))
+	// user::rw- user:1000:rw- group::r-- mask::rw- other::r--, on a file of
+	// mode 0664 as the mask is the group permissions of the file
+	acl := "\x02\x00\x00\x00" +
+		"\x01\x00\x06\x00\xff\xff\xff\xff" +
+		"\x02\x00\x06\x00\xe8\x03\x00\x00" +
+		"\x04\x00\x04\x00\xff\xff\xff\xff" +
+		"\x10\x00\x06\x00\xff\xff\xff\xff" +
+		"\x20\x00\x04\x00\xff\xff\xff\xff"
+
+	shared := xattrFile("bin/shared", map[string]string{"system.posix_acl_access": acl})
+	shared.header.Mode = 0664
+
+	export := testExport(t,
+		[]testEntry{dirEntry("bin/", 0755), fileEntry("bin/sh", "sh")},
+		[]testEntry{
+			dirEntry("bin/", 0755),
+			xattrFile("bin/ping", map[string]string{"security.capability": capability}),
+			xattrFile("bin/tool", map[string]string{"user.old": "1", "trusted.overlay": "y"}),
+			xattrFile("bin/labelled", map[string]string{selinuxXattr: "system_u:object_r:bin_t:s0"}),
+			shared,
+		},
+		[]testEntry{
+			dirEntry("bin/", 0755),
+			xattrFile("bin/tool", map[string]string{"user.new": "2", "security.ima": "hash"}),
+		},
+	)
+	_, headers := squashTestExport(t, export)
+
+	want := map[string][]string{
+		"./bin/ping":     {fmt.Sprintf("security.capability=%q", capability)},
+		"./bin/tool":     {`security.ima="hash"`, `user.new="2"`},
+		"./bin/labelled": {`security.selinux="system_u:object_r:bin_t:s0"`},
+		"./bin/shared":   {fmt.Sprintf("system.posix_acl_access=%q", acl)},
+	}
+	for name, attrs := range want {
+		h := headers[name]
+		if h == nil {
+			t.Errorf("%s is missing", name)
+			continue
+		}
+		if got := xattrs(h); fmt.Sprint(got) != fmt.Sprint(attrs) {
+			t.Errorf("%s has xattrs %v, want %v", name, got, attrs)
+		}
+	}
+
+	for name, h := range headers {
+		for _, key := range []string{"atime", "ctime"} {
+			if _, ok := h.PAXRecords[key]; ok {
+				t.Errorf("%s has a PAX %s record", name, key)
+			}
+		}
+	}
+}
+
+func TestSquashLeavesOutHostSELinuxLabels(t *testing.T) {
+	requireSquash(t)
+
+	export := testExport(t,
+		[]testEntry{dirEntry("bin/", 0755), fileEntry("bin/sh", "sh")},
+		[]testEntry{dirEntry("bin/", 0755), fileEntry("bin/tool", "tool")},
+	)
+	squashed, err := export.InsertLayer(export.Root().LayerConfig.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := export.SquashLayers(squashed, squashed, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// label the extracted file as an SELinux host does
+	fn := filepath.Join(squashed.LayerDirPath, "bin", "tool")
+	if err := setXattrs(fn, map[string]string{selinuxXattr: "system_u:object_r:container_file_t:s0"}); err != nil {
+		t.Skipf("can't set SELinux labels: %s", err)
+	}
+
+	if err := squashed.TarLayer(); err != nil {
+		t.Fatal(err)
+	}
+	h := readTestHeaders(t, squashed.LayerTarPath)["./bin/tool"]
+	if h == nil {
+		t.Fatal("./bin/tool is missing")
+	}
+	if attrs := xattrs(h); len(attrs) != 0 {
+		t.Errorf("./bin/tool has xattrs %v, want none", attrs)
+	}
+}
+
+func TestSquashKeepsSpecialFiles(t *testing.T) {
+	requireSquash(t)
+
+	device := func(name string, typeflag byte, major, minor int64) testEntry {
+		return testEntry{header: &tar.Header{Name: name, Typeflag: typeflag, Mode: 0666,
+			Devmajor: major, Devminor: minor, ModTime: time.Unix(1500000000, 0)}}
+	}
+
+	export := testExport(t,
+		[]testEntry{dirEntry("dev/", 0755)},
+		[]testEntry{
+			dirEntry("dev/", 0755),
+			device("dev/null", tar.TypeChar, 1, 3),
+			device("dev/sda", tar.TypeBlock, 8, 0),
+			device("dev/old", tar.TypeChar, 1, 5),
+			device("dev/initctl", tar.TypeFifo, 0, 0),
+		},
+		[]testEntry{
+			dirEntry("dev/", 0755),
+			fileEntry("dev/.wh.old", ""),
+		},
+	)
+	_, headers := squashTestExport(t, export)
+
+	want := map[string]struct {
+		typeflag     byte
+		major, minor int64
+	}{
+		"./dev/null":    {tar.TypeChar, 1, 3},
+		"./dev/sda":     {tar.TypeBlock, 8, 0},
+		"./dev/initctl": {tar.TypeFifo, 0, 0},
+	}
+	for name, w := range want {
+		h := headers[name]
+		if h == nil {
+			t.Errorf("%s is missing", name)
+			continue
+		}
+		if h.Typeflag != w.typeflag || h.Devmajor != w.major || h.Devminor != w.minor {
+			t.Errorf("%s is %c %d,%d, want %c %d,%d", name, h.Typeflag, h.Devmajor, h.Devminor,
+				w.typeflag, w.major, w.minor)
+		}
+	}
+	if headers["./dev/old"] != nil {
+		t.Errorf("deleted device ./dev/old is in the squashed layer")
+	}
+}
+
+func TestSquashKeepsSparseFiles(t *testing.T) {
+	requireSquash(t)
+
+	// GNU tar writes the sparse layer, as Go can't
+	dir, err := ioutil.TempDir("", "docker-squash-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const size = 64 << 20
+	f, err := os.Create(filepath.Join(dir, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("data"), size/2); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	layer := filepath.Join(dir, "layer.tar")
+	if out, err := exec.Command(TarCmd, "cf", layer, "-C", dir, "--sparse", "sparse").CombinedOutput(); err != nil {
+		t.Fatal(string(out))
+	}
+	b, err := ioutil.ReadFile(layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	export := testExport(t, []testEntry{dirEntry("etc/", 0755)})
+	addTestLayer(t, export, export.LastChild().LayerConfig.Id, "/bin/sh -c truncate", b)
+	squashed, headers := squashTestExport(t, export)
+
+	h := headers["./sparse"]
+	if h == nil {
+		t.Fatal("./sparse is missing")
+	}
+	if h.Size != size {
+		t.Errorf("./sparse has size %d, want %d", h.Size, size)
+	}
+
+	fi, err := os.Stat(squashed.LayerTarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() > 1<<20 {
+		t.Errorf("squashed layer has %d bytes. The holes of ./sparse were written out", fi.Size())
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"archive/tar"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// restoreLinkTargets copies into location the files that hard links in
+// entries are made to, when the files come from the layers below rather
+// than from location or the entries themselves.  tar can then recreate the
+// links instead of failing on a missing target.  The files are extracted
+// from the layer that wrote them, and missing parent dirs are created with
+// their metadata from below.
+func restoreLinkTargets(below []*ExportedImage, location string, entries []*layerEntry) error {
+	var lower FileIndex
+	written := map[string]bool{}
+	for _, le := range entries {
+		written[le.Path] = true
+		if le.Header.Typeflag != tar.TypeLink {
+			continue
+		}
+
+		target := cleanPath(le.Header.Linkname)
+		if written[target] || whitedOut(location, target) {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(location, target)); err == nil {
+			continue
+		}
+
+		if lower == nil {
+			lower = FileIndex{}
+			for _, entry := range below {
+				lowerEntries, err := readLayerEntries(entry.LayerTarPath, false)
+				if err != nil {
+					return err
+				}
+				lower.apply(entry.LayerConfig.Id, lowerEntries)
+			}
+		}
+
+		fe := lower[target]
+		if fe == nil || !isRegular(fe.content().Header) {
+			continue
+		}
+		debugf("  -  Restoring %s from %s for hard link %s\n", target, truncateID(fe.content().Layer), le.Path)
+		created, err := restoreDirs(location, path.Dir(target), lower)
+		if err != nil {
+			return err
+		}
+		if err := restoreFile(below, location, target, fe.content()); err != nil {
+			return err
+		}
+
+		// set the mtimes once nothing more is added to the dirs
+		for i := len(created) - 1; i >= 0; i-- {
+			mtime := created[i].Header.ModTime
+			if err := os.Chtimes(filepath.Join(location, created[i].Path), mtime, mtime); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// whitedOut returns true if a whiteout in location deletes p or one of its
+// parent dirs from the layers below.
+func whitedOut(location, p string) bool {
+	for c := p; c != "/"; c = path.Dir(c) {
+		dir, base := path.Split(c)
+		for _, wh := range []string{whiteoutPrefix + base, opaqueWhiteout} {
+			if _, err := os.Lstat(filepath.Join(location, dir, wh)); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// restoreDirs creates the dir p and its parents in location, with the mode
+// and owner they have in the lower index.  The entries of the dirs created
+// are returned, from the top.
+func restoreDirs(location, p string, lower FileIndex) ([]*FileEntry, error) {
+	if p == "/" {
+		return nil, nil
+	}
+	created, err := restoreDirs(location, path.Dir(p), lower)
+	if err != nil {
+		return nil, err
+	}
+
+	fn := filepath.Join(location, p)
+	if _, err := os.Lstat(fn); err == nil {
+		return created, nil
+	}
+
+	fe := lower[p]
+	if fe == nil || fe.Header.Typeflag != tar.TypeDir {
+		return created, os.Mkdir(fn, 0755)
+	}
+	if err := os.Mkdir(fn, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Lchown(fn, fe.Header.Uid, fe.Header.Gid); err != nil {
+		return nil, err
+	}
+	mode := fe.Header.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if err := os.Chmod(fn, mode); err != nil {
+		return nil, err
+	}
+	return append(created, fe), nil
+}
+
+// restoreFile extracts the regular file of fe from the layer tar that wrote
+// it, and moves it to target in location.
+func restoreFile(below []*ExportedImage, location, target string, fe *FileEntry) error {
+	var layer *ExportedImage
+	for _, entry := range below {
+		if entry.LayerConfig.Id == fe.Layer {
+			layer = entry
+		}
+	}
+	if layer == nil {
+		return nil
+	}
+
+	scratch := filepath.Join(filepath.Dir(location), "links")
+	if err := os.MkdirAll(scratch, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratch)
+
+	out, err := extractTar(layer.LayerTarPath, scratch, nil, fe.Header.Name)
+	if err != nil {
+		println(string(out))
+		return err
+	}
+	return os.Rename(filepath.Join(scratch, strings.TrimPrefix(fe.Path, "/")), filepath.Join(location, target))
+}
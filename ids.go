@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// RecordDiffIds writes the digest of the layer tar into the json of the
+// layers that aren't in original.
+func (e *Export) RecordDiffIds(original map[string]bool) error {
+	for _, entry := range e.Chain() {
+		if original[entry.LayerConfig.Id] {
+			continue
+		}
+
+		diffId, err := entry.DiffId()
+		if err != nil {
+			return err
+		}
+		entry.LayerConfig.DiffId = diffId
+		if err := entry.WriteJson(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReassignIds replaces the random IDs of the layers that aren't in
+// original with IDs derived from the ID of their parent, the digest of
+// their layer tar and their config, so that squashing the same image twice
+// produces the same IDs.  With chain, the IDs of layers with content are
+// derived from their parent and digest only, as chain IDs are, so that they
+// don't change with the config of the layer.  The digests only match from
+// one squash to the next when the layer tars are written reproducibly.
+func (e *Export) ReassignIds(original map[string]bool, chain bool) error {
+	ids := map[string]string{}
+	for _, entry := range e.Chain() {
+		oldId := entry.LayerConfig.Id
+		if newParent, ok := ids[entry.LayerConfig.Parent]; ok {
+			entry.LayerConfig.Parent = newParent
+		}
+
+		if original[oldId] {
+			if err := entry.WriteJson(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		cmd := entry.LayerConfig.ContainerConfig().Cmd
+		for i := range cmd {
+			for o, n := range ids {
+				cmd[i] = strings.Replace(cmd[i], o[:12], n[:12], -1)
+			}
+		}
+
+		var id string
+		var err error
+		if chain && !entry.MetadataOnly() {
+			id, err = chainId(entry)
+		} else {
+			id, err = contentId(entry)
+		}
+		if err != nil {
+			return err
+		}
+		ids[oldId] = id
+
+		debugf("  -  Renaming %s to %s\n", oldId[:12], id[:12])
+		if err := entry.rename(id); err != nil {
+			return err
+		}
+		delete(e.Entries, oldId)
+		e.Entries[id] = entry
+	}
+	return nil
+}
+
+// contentId returns the ID of a layer derived from its parent, the digest
+// of its layer tar and its config.
+func contentId(entry *ExportedImage) (string, error) {
+	diffId, err := entry.DiffId()
+	if err != nil {
+		return "", err
+	}
+
+	config := *entry.LayerConfig
+	config.Id = ""
+	configJson, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.Sum256([]byte(entry.LayerConfig.Parent + " " + diffId + " " + string(configJson)))
+	return validId(hex.EncodeToString(h[:])), nil
+}
+
+// chainId returns the ID of a layer derived from its parent and the digest
+// of its layer tar.
+func chainId(entry *ExportedImage) (string, error) {
+	diffId, err := entry.DiffId()
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.Sum256([]byte(entry.LayerConfig.Parent + " " + diffId))
+	return validId(hex.EncodeToString(h[:])), nil
+}
+
+// validId rehashes an ID until its short form isn't a number, as newID
+// does with random IDs.
+func validId(id string) string {
+	for {
+		if _, err := strconv.ParseInt(truncateID(id), 10, 64); err != nil {
+			return id
+		}
+		h := sha256.Sum256([]byte(id))
+		id = hex.EncodeToString(h[:])
+	}
+}
+
+// rename moves the layer to the dir of a new ID and rewrites its json.
+func (e *ExportedImage) rename(id string) error {
+	location := filepath.Dir(e.Path)
+	err := os.Rename(e.Path, filepath.Join(location, id))
+	if err != nil {
+		return err
+	}
+
+	e.Path = filepath.Join(location, id)
+	e.JsonPath = filepath.Join(location, id, "json")
+	e.VersionPath = filepath.Join(location, id, "VERSION")
+	e.LayerTarPath = filepath.Join(location, id, "layer.tar")
+	e.LayerDirPath = filepath.Join(location, id, "layer")
+	e.LayerConfig.Id = id
+	return e.WriteJson()
+}
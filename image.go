@@ -1,11 +1,16 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
-	"time"
+	"strings"
 )
 
 type ExportedImage struct {
@@ -15,6 +20,11 @@ type ExportedImage struct {
 	LayerTarPath string
 	LayerDirPath string
 	LayerConfig  *LayerConfig
+	Annotations  map[string]string // of a layer tar stored compressed, as eStargz
+
+	diffId      string    // digest of the uncompressed layer tar, once known
+	contentSize int64     // size of the files in the layer tar, once checked
+	merged      FileIndex // entries of the layers squashed into the layer dir
 }
 
 func newLayerConfig(id, parent, comment string) *LayerConfig {
@@ -22,7 +32,7 @@ func newLayerConfig(id, parent, comment string) *LayerConfig {
 		Id:            id,
 		Parent:        parent,
 		Comment:       comment,
-		Created:       time.Now().UTC(),
+		Created:       now(),
 		DockerVersion: "0.1.2",
 		Architecture:  "x86_64",
 	}
@@ -69,7 +79,24 @@ func (e *ExportedImage) CreateDirs() error {
 	return os.MkdirAll(e.Path, 0755)
 }
 
+// TarLayer writes the layer dir to the layer tar.  The layer dir itself has
+// no entry in the tar, only what's in it.
 func (e *ExportedImage) TarLayer() error {
+	if e.merged != nil {
+		if err := e.applyDirMetadata(); err != nil {
+			return err
+		}
+	}
+
+	children, err := ioutil.ReadDir(e.LayerDirPath)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for _, child := range children {
+		names = append(names, "./"+child.Name())
+	}
+
 	cwd, err := os.Getwd()
 	if err != nil {
 		return err
@@ -81,29 +108,152 @@ func (e *ExportedImage) TarLayer() error {
 	}
 	defer os.Chdir(cwd)
 
-	cmd := exec.Command("sudo", "/bin/sh", "-c", fmt.Sprintf("%s cvf ../layer.tar ./", TarCmd))
-	out, err := cmd.CombinedOutput()
+	f, err := os.Create(e.LayerTarPath)
 	if err != nil {
-		println(string(out))
 		return err
 	}
-	return nil
+	defer f.Close()
+
+	// hash the tar while writing it
+	// --xattrs writes POSIX archives, whose PAX headers would record the
+	// access and change times of the extracted files
+	args := []string{TarCmd, "cf", "-", "--xattrs", "--xattrs-include=*", "--sparse",
+		"--pax-option=delete=atime,delete=ctime"}
+	if !e.hasSELinuxLabels() {
+		args = append(args, "--xattrs-exclude="+selinuxXattr)
+	}
+	args = append(args, reproducibleTarArgs()...)
+	if !sourceDate.IsZero() {
+		// later sparse formats name sparse files after the pid of tar
+		args = append(args, "--sparse-version=0.0")
+	}
+	cmd := exec.Command("sudo", append(args, "--null", "-T", "-")...)
+	cmd.Stdin = strings.NewReader(strings.Join(names, "\x00"))
+	h := sha256.New()
+	out := &bytes.Buffer{}
+	cmd.Stdout = io.MultiWriter(f, h)
+	cmd.Stderr = out
+	err = cmd.Run()
+	if err != nil {
+		println(out.String())
+		return err
+	}
+
+	e.diffId = "sha256:" + hex.EncodeToString(h.Sum(nil))
+	f.Close()
+
+	if e.merged == nil {
+		return nil
+	}
+	if err := e.appendDevices(); err != nil {
+		return err
+	}
+	return e.checkFidelity()
 }
 
 func (e *ExportedImage) RemoveLayerDir() error {
 	return os.RemoveAll(e.LayerDirPath)
 }
 
-func (e *ExportedImage) ExtractLayerDir() error {
+// ExtractLayerDir extracts the layer tar to the layer dir.  below are the
+// layers under it, from the root, which hard links of the layer may link to.
+func (e *ExportedImage) ExtractLayerDir(below []*ExportedImage) error {
 	err := os.MkdirAll(e.LayerDirPath, 0755)
 	if err != nil {
 		return err
 	}
 
-	out, err := extractTar(e.LayerTarPath, e.LayerDirPath)
+	entries, err := readLayerEntries(e.LayerTarPath, false)
+	if err != nil {
+		return err
+	}
+	counter := &limitCounter{layer: e.LayerConfig.Id}
+	for _, le := range entries {
+		if err := counter.add(le.Header); err != nil {
+			return err
+		}
+	}
+	err = confineLayer(e.LayerConfig.Id, e.LayerDirPath, entries)
+	if err != nil {
+		return err
+	}
+	err = restoreLinkTargets(below, e.LayerDirPath, entries)
+	if err != nil {
+		return err
+	}
+
+	out, err := extractTar(e.LayerTarPath, e.LayerDirPath, deviceNames(entries))
 	if err != nil {
 		println(string(out))
 		return err
 	}
 	return nil
 }
+
+// MetadataOnly returns true if the layer only changes the image config, as
+// ENV, LABEL or CMD instructions do.  These layers have no entries in their
+// layer.tar beyond the root dir.  If the layer.tar can't be read, the layer
+// is classified by its Dockerfile command instead.
+func (e *ExportedImage) MetadataOnly() bool {
+	empty, err := layerIsEmpty(e.LayerTarPath)
+	if err == nil {
+		return empty
+	}
+
+	debugf("  -  Classifying %s by command: %s\n", e.LayerConfig.Id[:12], err)
+	cmd := strings.Join(e.LayerConfig.ContainerConfig().Cmd, " ")
+	return strings.Contains(cmd, "#(nop)") && !(strings.Contains(cmd, "ADD") || strings.Contains(cmd, "COPY"))
+}
+
+// Classification describes the kind of layer for verbose output.
+func (e *ExportedImage) Classification() string {
+	if e.MetadataOnly() {
+		return "metadata"
+	}
+	return "content"
+}
+
+// layerIsEmpty returns true if the tar archive at p has no entries besides
+// the root dir.  It stops reading at the first other entry.
+func layerIsEmpty(p string) (bool, error) {
+	f, err := openLayerTar(p)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	t := tar.NewReader(f)
+	for {
+		header, err := t.Next()
+		if err != nil {
+			if err == io.EOF {
+				return true, nil
+			}
+			return false, err
+		}
+
+		if cleanPath(header.Name) != "/" {
+			return false, nil
+		}
+	}
+}
+
+// DiffId returns the digest of the uncompressed layer tar.
+func (e *ExportedImage) DiffId() (string, error) {
+	if e.diffId != "" {
+		return e.diffId, nil
+	}
+
+	f, err := openLayerTar(e.LayerTarPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	e.diffId = "sha256:" + hex.EncodeToString(h.Sum(nil))
+	return e.diffId, nil
+}
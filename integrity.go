@@ -0,0 +1,252 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// IntegrityKind is the kind of an inconsistency found in an export.
+type IntegrityKind int
+
+const (
+	LayerIdMismatch IntegrityKind = iota
+	MissingParent
+	ParentCycle
+	NoRoot
+	SeveralRoots
+	SeveralChildren
+	OrphanLayer
+	MissingLayerTar
+	TruncatedLayerTar
+	DiffIdMismatch
+	MissingJson
+)
+
+func (k IntegrityKind) String() string {
+	switch k {
+	case LayerIdMismatch:
+		return "id mismatch"
+	case MissingParent:
+		return "missing parent"
+	case ParentCycle:
+		return "parent cycle"
+	case NoRoot:
+		return "no root"
+	case SeveralRoots:
+		return "several roots"
+	case SeveralChildren:
+		return "several children"
+	case OrphanLayer:
+		return "orphan layer"
+	case MissingLayerTar:
+		return "missing layer.tar"
+	case TruncatedLayerTar:
+		return "truncated layer.tar"
+	case DiffIdMismatch:
+		return "diff_id mismatch"
+	case MissingJson:
+		return "missing json"
+	}
+	return fmt.Sprintf("IntegrityKind(%d)", k)
+}
+
+// IntegrityError is an inconsistency found in an export.  Layer is the ID
+// of the offending layer, if any.
+type IntegrityError struct {
+	Kind   IntegrityKind
+	Layer  string
+	Detail string
+}
+
+func (e *IntegrityError) Error() string {
+	if e.Layer == "" {
+		return fmt.Sprintf("%s: %s", e.Kind, e.Detail)
+	}
+	return fmt.Sprintf("layer %s: %s: %s", truncateID(e.Layer), e.Kind, e.Detail)
+}
+
+// dockerManifest is an entry of the manifest.json written by docker save
+// since docker 1.10.
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// Check verifies that the layers of the export form a single chain from
+// one root, and that every layer tar can be read to its end and matches the
+// diff_id recorded for it in manifest.json, the image config or the layer
+// json.
+func (e *Export) Check() error {
+	if err := e.checkChain(); err != nil {
+		return err
+	}
+
+	expected, err := e.expectedDiffIds()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range e.Chain() {
+		if err := entry.checkLayerTar(expected[entry.LayerConfig.Id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Export) checkChain() error {
+	if len(e.Entries) == 0 {
+		return &IntegrityError{Kind: NoRoot, Detail: "the export has no layers"}
+	}
+
+	roots := []string{}
+	children := map[string][]string{}
+	for id, entry := range e.Entries {
+		if filepath.Base(entry.Path) != id {
+			return &IntegrityError{Kind: LayerIdMismatch, Layer: filepath.Base(entry.Path),
+				Detail: fmt.Sprintf("its json has id %s", id)}
+		}
+
+		parent := entry.LayerConfig.Parent
+		if parent == "" {
+			roots = append(roots, id)
+			continue
+		}
+		if _, ok := e.Entries[parent]; !ok {
+			return &IntegrityError{Kind: MissingParent, Layer: id,
+				Detail: fmt.Sprintf("parent %s is not in the export", parent)}
+		}
+		children[parent] = append(children[parent], id)
+	}
+
+	for id := range e.Entries {
+		seen := map[string]bool{}
+		for p := id; p != ""; p = e.Entries[p].LayerConfig.Parent {
+			if seen[p] {
+				return &IntegrityError{Kind: ParentCycle, Layer: id,
+					Detail: fmt.Sprintf("%s is its own ancestor", truncateID(p))}
+			}
+			seen[p] = true
+		}
+	}
+
+	if len(roots) == 0 {
+		return &IntegrityError{Kind: NoRoot, Detail: "every layer has a parent"}
+	}
+	if len(roots) > 1 {
+		sort.Strings(roots)
+		return &IntegrityError{Kind: SeveralRoots, Layer: roots[0],
+			Detail: fmt.Sprintf("%d layers have no parent", len(roots))}
+	}
+
+	for parent, ids := range children {
+		if len(ids) > 1 {
+			return &IntegrityError{Kind: SeveralChildren, Layer: parent,
+				Detail: fmt.Sprintf("%d layers have it as parent. The export has several images in it. "+
+					"It needs to be generated from a specific image ID or tag.", len(ids))}
+		}
+	}
+
+	chain := map[string]bool{}
+	for _, entry := range e.Chain() {
+		chain[entry.LayerConfig.Id] = true
+	}
+	for id := range e.Entries {
+		if !chain[id] {
+			return &IntegrityError{Kind: OrphanLayer, Layer: id, Detail: "it is not above the root layer"}
+		}
+	}
+	return nil
+}
+
+// expectedDiffIds returns the diff_ids of the layers, from the manifest.json
+// and image config of the export, or else from the layer json.
+func (e *Export) expectedDiffIds() (map[string]string, error) {
+	expected := map[string]string{}
+	for id, entry := range e.Entries {
+		if entry.LayerConfig.DiffId != "" {
+			expected[id] = entry.LayerConfig.DiffId
+		}
+	}
+
+	manifests := []dockerManifest{}
+	err := readJsonFile(filepath.Join(e.Path, "manifest.json"), &manifests)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range manifests {
+		if _, err := relativeName(m.Config); err != nil {
+			return nil, &UnsafeEntryError{Name: m.Config, Reason: err.Error()}
+		}
+		config := &ociConfig{}
+		if err := readJsonFile(filepath.Join(e.Path, m.Config), config); err != nil {
+			return nil, err
+		}
+		if len(config.RootFS.DiffIds) != len(m.Layers) {
+			return nil, &IntegrityError{Kind: DiffIdMismatch, Detail: fmt.Sprintf("%s has %d diff_ids for %d layers",
+				m.Config, len(config.RootFS.DiffIds), len(m.Layers))}
+		}
+		for i, layer := range m.Layers {
+			if id := e.layerId(layer); id != "" {
+				expected[id] = config.RootFS.DiffIds[i]
+			}
+		}
+	}
+	return expected, nil
+}
+
+// checkLayerTar reads the layer tar to its end, and compares its digest with
+// diffId unless it's empty.  A layer without a layer.tar has no files.  The
+// size of the files in the layer is kept for CheckDiskSpace.
+func (e *ExportedImage) checkLayerTar(diffId string) error {
+	id := e.LayerConfig.Id
+	f, err := openLayerTar(e.LayerTarPath)
+	if os.IsNotExist(err) {
+		if diffId != "" {
+			return &IntegrityError{Kind: MissingLayerTar, Layer: id, Detail: fmt.Sprintf("expected %s", diffId)}
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	r := io.TeeReader(f, h)
+	t := tar.NewReader(r)
+	size := int64(0)
+	for {
+		header, err := t.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			size += header.Size
+			_, err = io.Copy(ioutil.Discard, t)
+		}
+		if err != nil {
+			return &IntegrityError{Kind: TruncatedLayerTar, Layer: id, Detail: err.Error()}
+		}
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return &IntegrityError{Kind: TruncatedLayerTar, Layer: id, Detail: err.Error()}
+	}
+
+	actual := hashDigest(h)
+	if diffId != "" && actual != diffId {
+		return &IntegrityError{Kind: DiffIdMismatch, Layer: id,
+			Detail: fmt.Sprintf("layer.tar has digest %s, expected %s", actual, diffId)}
+	}
+	e.diffId = actual
+	e.contentSize = size
+	return nil
+}
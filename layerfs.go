@@ -0,0 +1,278 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+type ChangeKind int
+
+const (
+	ChangeAdd ChangeKind = iota
+	ChangeModify
+	ChangeDelete
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeAdd:
+		return "A"
+	case ChangeModify:
+		return "M"
+	case ChangeDelete:
+		return "D"
+	}
+	return "?"
+}
+
+// Change is a single path added, modified or deleted by a layer.
+type Change struct {
+	Path     string
+	Kind     ChangeKind
+	Size     int64
+	Replaced []*FileEntry // entries of lower layers hidden by the change
+}
+
+// FileEntry is a path in a replayed layer stack.
+type FileEntry struct {
+	Path   string
+	Header *tar.Header
+	Digest string     // sha256 of the content of regular files
+	Layer  string     // id of the layer that last wrote the path
+	Group  *FileEntry // regular file a hard link was made to, even if since deleted
+}
+
+// content returns the entry holding the metadata and content of the file,
+// which is the first entry of its group for hard links.
+func (fe *FileEntry) content() *FileEntry {
+	if fe.Group != nil {
+		return fe.Group
+	}
+	return fe
+}
+
+// FileIndex maps absolute paths to the entry visible at that path after
+// replaying a stack of layers.
+type FileIndex map[string]*FileEntry
+
+// layerEntry is a single tar entry read from a layer.tar.
+type layerEntry struct {
+	Header *tar.Header
+	Path   string
+	Digest string
+}
+
+func (le *layerEntry) whiteout() (target string, opaque, ok bool) {
+	dir, base := path.Split(le.Path)
+	if base == opaqueWhiteout {
+		return path.Clean(dir), true, true
+	}
+	if strings.HasPrefix(base, whiteoutPrefix) {
+		return path.Join(dir, base[len(whiteoutPrefix):]), false, true
+	}
+	return "", false, false
+}
+
+// cleanPath converts a tar entry name to an absolute, cleaned path.
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// isChildOf returns true if p is below dir.
+func isChildOf(p, dir string) bool {
+	if dir == "/" {
+		return p != "/"
+	}
+	return strings.HasPrefix(p, dir+"/")
+}
+
+func openLayerTar(p string) (io.ReadCloser, error) {
+	return openCompressed(p)
+}
+
+// readLayerEntries returns the tar headers of a layer.tar, optionally
+// hashing the content of regular files.  A missing layer.tar has no entries.
+func readLayerEntries(p string, hash bool) ([]*layerEntry, error) {
+	f, err := openLayerTar(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []*layerEntry{}
+	t := tar.NewReader(f)
+	for {
+		header, err := t.Next()
+		if err != nil {
+			if err == io.EOF {
+				return entries, nil
+			}
+			return nil, err
+		}
+
+		le := &layerEntry{
+			Header: header,
+			Path:   cleanPath(header.Name),
+		}
+
+		if hash && isRegular(header) {
+			h := sha256.New()
+			if _, err := io.Copy(h, t); err != nil {
+				return nil, err
+			}
+			le.Digest = hex.EncodeToString(h.Sum(nil))
+		}
+		entries = append(entries, le)
+	}
+}
+
+// paxXattr prefixes the PAX records of extended attributes.
+const paxXattr = "SCHILY.xattr."
+
+// xattrs returns the extended attributes of a tar entry as sorted
+// "name=value" pairs.
+func xattrs(h *tar.Header) []string {
+	pairs := []string{}
+	for k, v := range h.PAXRecords {
+		if strings.HasPrefix(k, paxXattr) {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", strings.TrimPrefix(k, paxXattr), v))
+		}
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+func isRegular(h *tar.Header) bool {
+	return h.Typeflag == tar.TypeReg || h.Typeflag == tar.TypeRegA
+}
+
+// remove deletes p and everything below it, returning the removed entries.
+func (fi FileIndex) remove(p string, childrenOnly bool) []*FileEntry {
+	removed := []*FileEntry{}
+	for k, v := range fi {
+		if (k == p && !childrenOnly) || isChildOf(k, p) {
+			removed = append(removed, v)
+			delete(fi, k)
+		}
+	}
+	return removed
+}
+
+// apply replays the entries of a layer on top of the index and returns the
+// changes it made.  Whiteouts are applied before any content of the layer so
+// that a layer can replace a path it deletes.
+func (fi FileIndex) apply(layer string, entries []*layerEntry) []*Change {
+	changes := []*Change{}
+
+	for _, le := range entries {
+		target, opaque, ok := le.whiteout()
+		if !ok {
+			continue
+		}
+
+		removed := fi.remove(target, opaque)
+		if opaque {
+			for _, r := range removed {
+				changes = append(changes, &Change{
+					Path:     r.Path,
+					Kind:     ChangeDelete,
+					Size:     r.Header.Size,
+					Replaced: []*FileEntry{r},
+				})
+			}
+			continue
+		}
+
+		if len(removed) == 0 {
+			continue
+		}
+		size := int64(0)
+		for _, r := range removed {
+			size += r.Header.Size
+		}
+		changes = append(changes, &Change{Path: target, Kind: ChangeDelete, Size: size, Replaced: removed})
+	}
+
+	for _, le := range entries {
+		if _, _, ok := le.whiteout(); ok || le.Path == "/" {
+			continue
+		}
+
+		old := fi[le.Path]
+		fe := &FileEntry{Path: le.Path, Header: le.Header, Digest: le.Digest, Layer: layer}
+		if le.Header.Typeflag == tar.TypeLink {
+			if target := fi[cleanPath(le.Header.Linkname)]; target != nil {
+				fe.Group = target.content()
+			}
+		}
+		fi[le.Path] = fe
+
+		switch {
+		case old == nil:
+			changes = append(changes, &Change{Path: le.Path, Kind: ChangeAdd, Size: le.Header.Size})
+		case le.Header.Typeflag == tar.TypeDir && old.Header.Typeflag == tar.TypeDir &&
+			sameMetadata(old.Header, le.Header):
+			// Parent directories are repeated in each layer that writes below them.
+		default:
+			changes = append(changes, &Change{
+				Path:     le.Path,
+				Kind:     ChangeModify,
+				Size:     le.Header.Size,
+				Replaced: []*FileEntry{old},
+			})
+		}
+	}
+
+	sort.Sort(changesByPath(changes))
+	return changes
+}
+
+func sameMetadata(a, b *tar.Header) bool {
+	return a.Mode == b.Mode && a.Uid == b.Uid && a.Gid == b.Gid
+}
+
+type changesByPath []*Change
+
+func (c changesByPath) Len() int           { return len(c) }
+func (c changesByPath) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c changesByPath) Less(i, j int) bool { return c[i].Path < c[j].Path }
+
+// Chain returns the layers of the export ordered from the root.
+func (e *Export) Chain() []*ExportedImage {
+	order := []*ExportedImage{}
+	current := e.Root()
+	for current != nil {
+		order = append(order, current)
+		current = e.ChildOf(current.LayerConfig.Id)
+	}
+	return order
+}
+
+// FileIndex replays every layer of the export and returns the resulting
+// filesystem.
+func (e *Export) FileIndex(hash bool) (FileIndex, error) {
+	fi := FileIndex{}
+	for _, entry := range e.Chain() {
+		entries, err := readLayerEntries(entry.LayerTarPath, hash)
+		if err != nil {
+			return nil, err
+		}
+		fi.apply(entry.LayerConfig.Id, entries)
+	}
+	return fi, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/docker/docker/pkg/units"
+)
+
+// Limits caps what extracting an archive or a layer may write, against
+// archive bombs from untrusted images.  Zero disables a cap.
+type Limits struct {
+	Bytes      int64 // total size of the files of the archive or layer
+	FileSize   int64
+	Entries    int
+	PathLength int
+	Depth      int
+	Layers     int
+}
+
+var limits = Limits{
+	Bytes:      64 << 30,
+	FileSize:   16 << 30,
+	Entries:    2000000,
+	PathLength: 4096,
+	Depth:      256,
+	Layers:     128,
+}
+
+// LimitError is an archive or layer exceeding one of the limits.  Layer is
+// empty for entries of the export itself.
+type LimitError struct {
+	Layer string
+	Name  string
+	Limit string
+	Value int64
+	Max   int64
+}
+
+func (e *LimitError) Error() string {
+	msg := fmt.Sprintf("%s %d exceeds the limit of %d", e.Limit, e.Value, e.Max)
+	if e.Name != "" {
+		msg = fmt.Sprintf("entry %s: %s", e.Name, msg)
+	}
+	if e.Layer != "" {
+		msg = fmt.Sprintf("layer %s: %s", truncateID(e.Layer), msg)
+	}
+	return msg
+}
+
+// limitCounter checks the entries of an archive or layer being extracted
+// against the limits.  Bytes and entries add up across calls, so a counter
+// shared by several layers limits the layer they are merged into.
+type limitCounter struct {
+	layer   string
+	bytes   int64
+	entries int
+}
+
+func (c *limitCounter) add(h *tar.Header) error {
+	c.entries++
+	c.bytes += h.Size
+
+	name := strings.TrimPrefix(path.Clean("/"+h.Name), "/")
+	checks := []struct {
+		limit      string
+		value, max int64
+	}{
+		{"path length", int64(len(h.Name)), int64(limits.PathLength)},
+		{"depth", int64(strings.Count(name, "/") + 1), int64(limits.Depth)},
+		{"file size", h.Size, limits.FileSize},
+		{"entry count", int64(c.entries), int64(limits.Entries)},
+		{"total size", c.bytes, limits.Bytes},
+	}
+	for _, check := range checks {
+		if check.max > 0 && check.value > check.max {
+			return &LimitError{Layer: c.layer, Name: h.Name, Limit: check.limit,
+				Value: check.value, Max: check.max}
+		}
+	}
+	return nil
+}
+
+// checkLayerCount returns an error if the export has more layers than
+// allowed.
+func (e *Export) checkLayerCount() error {
+	if limits.Layers > 0 && len(e.Entries) > limits.Layers {
+		return &LimitError{Limit: "layer count", Value: int64(len(e.Entries)), Max: int64(limits.Layers)}
+	}
+	return nil
+}
+
+// freeSpace returns the bytes available to unprivileged users on the
+// filesystem of dir.
+func freeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+func checkFreeSpace(dir string, need int64) error {
+	free, err := freeSpace(dir)
+	if err != nil {
+		return err
+	}
+	if need > free {
+		return errors.New(fmt.Sprintf("not enough space in %s: need %s, %s free. Set TMPDIR to a larger disk",
+			dir, units.HumanSize(float64(need)), units.HumanSize(float64(free))))
+	}
+	return nil
+}
+
+// declaredSize returns the total size of the entries of an uncompressed tar
+// archive, skipping over their content.  Compressed archives can't be
+// measured without decompressing them, and have a size of 0.
+func declaredSize(f *os.File) (int64, error) {
+	header := make([]byte, 6)
+	n, err := f.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if detectCompression(header[:n]) != Uncompressed {
+		return 0, nil
+	}
+
+	defer f.Seek(0, io.SeekStart)
+
+	size := int64(0)
+	t := tar.NewReader(f)
+	for {
+		h, err := t.Next()
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		size += h.Size
+	}
+}
+
+// CheckDiskSpace checks that the temp dir has room for the layers of the
+// export.  The files of every layer are extracted, merged again into the
+// squashed layers and tarred up, so up to three times the declared size of
+// the layer tars is needed.  Layers that weren't checked count the size of
+// their layer tar.
+func (e *Export) CheckDiskSpace() error {
+	size := int64(0)
+	for _, entry := range e.Entries {
+		if entry.contentSize > 0 {
+			size += entry.contentSize
+			continue
+		}
+		if fi, err := os.Stat(entry.LayerTarPath); err == nil {
+			size += fi.Size()
+		}
+	}
+	return checkFreeSpace(e.Path, 3*size)
+}
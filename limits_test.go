@@ -0,0 +1,85 @@
+package main
+
+import "testing"
+
+// squashLimitsExport returns an export whose squashed layers have 5
+// entries, 25 bytes of files, a depth of 3 and paths of up to 5 characters.
+func squashLimitsExport(t *testing.T) (*Export, *ExportedImage) {
+	export := testExport(t,
+		[]testEntry{dirEntry("etc/", 0755)},
+		[]testEntry{dirEntry("a/", 0755), dirEntry("a/b/", 0755),
+			fileEntry("a/b/c", "0123456789"), fileEntry("a/d", "0123456789")},
+		[]testEntry{fileEntry("e", "01234")},
+	)
+	squashed, err := export.InsertLayer(export.Root().LayerConfig.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return export, squashed
+}
+
+func setTestLimits(t *testing.T, l Limits) {
+	saved := limits
+	limits = l
+	t.Cleanup(func() { limits = saved })
+}
+
+func TestSquashLimits(t *testing.T) {
+	tests := []struct {
+		limit  string
+		limits Limits
+	}{
+		{"entry count", Limits{Entries: 4}},
+		{"total size", Limits{Bytes: 24}},
+		{"file size", Limits{FileSize: 9}},
+		{"depth", Limits{Depth: 2}},
+		{"path length", Limits{PathLength: 4}},
+	}
+	for _, test := range tests {
+		setTestLimits(t, test.limits)
+		export, squashed := squashLimitsExport(t)
+
+		err := export.SquashLayers(squashed, squashed, nil)
+		le, ok := err.(*LimitError)
+		if !ok || le.Limit != test.limit {
+			t.Errorf("%s: got error %v, want a LimitError", test.limit, err)
+			continue
+		}
+		if le.Value != le.Max+1 || le.Layer == "" {
+			t.Errorf("%s: got %s, want the value just above the limit in a layer", test.limit, le)
+		}
+	}
+}
+
+func TestSquashAtLimits(t *testing.T) {
+	requireSquash(t)
+
+	setTestLimits(t, Limits{Entries: 5, Bytes: 25, FileSize: 10, Depth: 3, PathLength: 5})
+	export, squashed := squashLimitsExport(t)
+	if err := export.SquashLayers(squashed, squashed, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLayerCountLimit(t *testing.T) {
+	export, _ := squashLimitsExport(t)
+
+	setTestLimits(t, Limits{Layers: len(export.Entries)})
+	if err := export.checkLayerCount(); err != nil {
+		t.Errorf("%d layers: %s", len(export.Entries), err)
+	}
+
+	setTestLimits(t, Limits{Layers: len(export.Entries) - 1})
+	if _, ok := export.checkLayerCount().(*LimitError); !ok {
+		t.Errorf("%d layers were accepted above the limit", len(export.Entries))
+	}
+}
+
+func TestSizeFlag(t *testing.T) {
+	for value, want := range map[string]int64{"0": 0, "25": 25, "512m": 512 << 20, "4g": 4 << 30} {
+		size := int64(-1)
+		if err := (sizeFlag{&size}).Set(value); err != nil || size != want {
+			t.Errorf("%s is %d, %v, want %d", value, size, err, want)
+		}
+	}
+}
@@ -3,18 +3,29 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"sync"
 	"syscall"
+
+	"github.com/docker/docker/pkg/units"
 )
 
 var (
 	buildVersion string
 	signals      chan os.Signal
 	wg           sync.WaitGroup
+
+	// commands are the subcommands selected by the first argument.
+	commands = map[string]func(args []string){
+		"analyze": runAnalyze,
+		"diff":    runDiff,
+		"verify":  runVerify,
+	}
 )
 
 func shutdown(tempdir string) {
@@ -28,21 +39,87 @@ func shutdown(tempdir string) {
 
 }
 
+// setupTempdir creates the working directory for an export and, unless
+// keepTemp is set, removes it on exit or interrupt.
+func setupTempdir(keepTemp bool) string {
+	signals = make(chan os.Signal, 1)
+
+	tempdir, err := ioutil.TempDir("", "docker-squash")
+	if err != nil {
+		fatal(err)
+	}
+
+	if !keepTemp {
+		wg.Add(1)
+		signal.Notify(signals, os.Interrupt, os.Kill, syscall.SIGTERM)
+		go shutdown(tempdir)
+	}
+	return tempdir
+}
+
+// cleanup removes the temp dir, if needed, and waits for it to finish.
+func cleanup() {
+	signals <- os.Interrupt
+	wg.Wait()
+}
+
 func main() {
-	var from, input, output, tempdir, tag string
-	var keepTemp, version, last bool
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+
+	var from, to, input, output, tempdir, tag, rangesFile, baseImage, knownFile, image, compress, prioritize string
+	var keepTemp, version, last, thin, load, estargz, reproducible, chainIds, dedupe, perLayer bool
+	var sharedWeight float64
+	var layers, compressLevel int
+	var shared, squash, dedupeExcludes stringsFlag
 	flag.StringVar(&input, "i", "", "Read from a tar archive file, instead of STDIN")
 	flag.StringVar(&output, "o", "", "Write to a file, instead of STDOUT")
+	flag.StringVar(&image, "image", "", "Read the image from the docker daemon, instead of STDIN. Implies -load without -o")
+	flag.BoolVar(&load, "load", false, "Load the new image into the docker daemon, instead of writing to STDOUT")
 	flag.StringVar(&tag, "t", "", "Repository name and tag for new image")
-	flag.StringVar(&from, "from", "", "Squash from layer ID (default: first FROM layer)")
+	flag.StringVar(&from, "from", "", "Squash from layer ID, root, auto or selector (default: first FROM layer)")
+	flag.StringVar(&baseImage, "base", "", "Base image tar archive or OCI layout. Squash from the top of its layers")
+	flag.StringVar(&to, "to", "", "Squash up to and including layer ID or selector, keeping the layers above it (default: last layer)")
+	flag.Var(&squash, "squash", "Squash the layers of range FROM..TO into one layer (may be repeated)")
+	flag.StringVar(&rangesFile, "ranges", "", "Read ranges to squash from a file, one FROM..TO per line")
+	flag.Var(&shared, "shared", "Base image tar archive whose layers are shared, for -from auto (may be repeated)")
+	flag.Float64Var(&sharedWeight, "shared-weight", 1, "Weight of shared bytes against pushed bytes, for -from auto")
 	flag.BoolVar(&last, "last", false, "Squash from last found layer ID (Inverts order for automatic root-layer selection")
+	flag.IntVar(&layers, "layers", 0, "Squash the layers above the squash point into this many layers")
+	flag.BoolVar(&thin, "thin", false, "Leave the unchanged base layers out of the output")
+	flag.StringVar(&knownFile, "known", "", "File with the IDs of the layers on the target, checked for -thin")
+	flag.StringVar(&compress, "compress", "", "Compress the output archive, or the new layers pushed to a registry, with gzip or zstd")
+	flag.IntVar(&compressLevel, "compress-level", 0, "Compression level for -compress (default: the default of the format)")
+	flag.BoolVar(&perLayer, "compress-layers", false, "Compress each layer of the output archive with -compress, instead of the whole archive")
+	flag.BoolVar(&estargz, "estargz", false, "Write the squashed layers as eStargz, for lazy pulling")
+	flag.StringVar(&prioritize, "estargz-prioritize", "", "File with the paths to prefetch from eStargz layers, in access order")
+	flag.BoolVar(&reproducible, "reproducible", false, "Produce the same output for the same input, dated SOURCE_DATE_EPOCH or the newest layer")
+	flag.BoolVar(&dedupe, "dedupe", false, "Hard link identical files in the squashed layers")
+	flag.Var(&dedupeExcludes, "dedupe-exclude", "Leave files matching pattern out of -dedupe (may be repeated)")
+	flag.BoolVar(&chainIds, "chain-ids", false, "Derive the IDs of new layers from their parent and content digest (implies -reproducible)")
+	flag.Var(sizeFlag{&limits.Bytes}, "max-size", "Largest total size of the files of the archive or of a layer, such as 64g (0: no limit)")
+	flag.Var(sizeFlag{&limits.FileSize}, "max-file-size", "Largest size of a single file (0: no limit)")
+	flag.IntVar(&limits.Entries, "max-entries", limits.Entries, "Most entries in the archive or in a layer (0: no limit)")
+	flag.IntVar(&limits.PathLength, "max-path-length", limits.PathLength, "Longest path of an entry (0: no limit)")
+	flag.IntVar(&limits.Depth, "max-depth", limits.Depth, "Deepest nesting of dirs of an entry (0: no limit)")
+	flag.IntVar(&limits.Layers, "max-layers", limits.Layers, "Most layers in the image (0: no limit)")
 	flag.BoolVar(&keepTemp, "keepTemp", false, "Keep temp dir when done. (Useful for debugging)")
 	flag.BoolVar(&verbose, "verbose", false, "Enable verbose logging")
 	flag.BoolVar(&version, "v", false, "Print version information and quit")
 
 	flag.Usage = func() {
-		fmt.Printf("\nUsage: docker-squash [options]\n\n")
-		fmt.Printf("Squashes the layers of a tar archive on STDIN and streams it to STDOUT\n\n")
+		fmt.Printf("\nUsage: docker-squash [options]\n")
+		fmt.Printf("       docker-squash [options] registry://host/repo:tag registry://host/repo:tag\n\n")
+		fmt.Printf("Squashes the layers of a tar archive on STDIN and streams it to STDOUT,\n")
+		fmt.Printf("or squashes an image in a registry and pushes it with a new tag\n\n")
+		fmt.Printf("Commands:\n")
+		fmt.Printf("  analyze  Report wasted space and squash savings\n")
+		fmt.Printf("  diff     List the changes made by each layer\n")
+		fmt.Printf("  verify   Check that a squashed image matches the original\n\n")
 		fmt.Printf("Options:\n")
 		flag.PrintDefaults()
 	}
@@ -53,10 +130,12 @@ func main() {
 		return
 	}
 
-	var err error
-	tempdir, err = ioutil.TempDir("", "docker-squash")
-	if err != nil {
-		fatal(err)
+	tempdir = setupTempdir(keepTemp)
+
+	// chain IDs are derived from digests that change with the dates of
+	// the squash otherwise
+	if chainIds {
+		reproducible = true
 	}
 
 	if tag != "" && strings.Contains(tag, ":") {
@@ -66,18 +145,108 @@ func main() {
 		}
 	}
 
-	signals = make(chan os.Signal, 1)
+	var pullRef, pushRef *RegistryRef
+	if flag.NArg() > 0 {
+		refs := []string{}
+		for _, arg := range flag.Args() {
+			if arg != "->" {
+				refs = append(refs, arg)
+			}
+		}
+		if len(refs) != 2 {
+			fatal("expected a source and a destination registry:// reference")
+		}
+		if input != "" || image != "" || output != "" || load || thin {
+			fatal("registry references cannot be combined with -i, -image, -o, -load or -thin")
+		}
 
-	if !keepTemp {
-		wg.Add(1)
-		signal.Notify(signals, os.Interrupt, os.Kill, syscall.SIGTERM)
-		go shutdown(tempdir)
+		var err error
+		pullRef, err = ParseRegistryRef(refs[0])
+		if err != nil {
+			fatal(err)
+		}
+		pushRef, err = ParseRegistryRef(refs[1])
+		if err != nil {
+			fatal(err)
+		}
 	}
 
-	export, err := LoadExport(input, tempdir)
+	var client *DockerClient
+	if image != "" || load {
+		var err error
+		client, err = NewDockerClient("")
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	var export *Export
+	var pulled *PulledImage
+	var registry *RegistryClient
+	var err error
+	compression, err := ParseCompression(compress)
 	if err != nil {
 		fatal(err)
 	}
+	if err := CheckCompressionLevel(compression, compressLevel); err != nil {
+		fatal(err)
+	}
+	if perLayer && (compression == Uncompressed || pushRef != nil) {
+		fatal("-compress-layers needs -compress, and cannot be combined with a registry destination")
+	}
+	if compression != Uncompressed && !perLayer && pushRef == nil && (load || image != "" && output == "") {
+		fatal("-compress cannot be combined with -load, as docker load reads the archive uncompressed")
+	}
+
+	if len(dedupeExcludes) > 0 && !dedupe {
+		fatal("-dedupe-exclude needs -dedupe")
+	}
+
+	var priority []string
+	if prioritize != "" {
+		if !estargz {
+			fatal("-estargz-prioritize needs -estargz")
+		}
+		priority, err = ReadPriorityFiles(prioritize)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	if pullRef != nil {
+		registry, err = NewRegistryClient()
+		if err != nil {
+			fatal(err)
+		}
+
+		export, pulled, err = registry.Pull(pullRef, filepath.Join(tempdir, "image"),
+			filepath.Join(tempdir, "blobs"))
+		if err != nil {
+			fatal(err)
+		}
+	} else if image != "" {
+		if input != "" {
+			fatal("-image cannot be combined with -i")
+		}
+
+		debugf("Loading export of %s from docker using %s for tempdir\n", image, tempdir)
+		r, err := client.SaveImage(image)
+		if err != nil {
+			fatal(err)
+		}
+		export, err = ReadExport(r, tempdir)
+		r.Close()
+		if err != nil {
+			fatal(err)
+		}
+
+		load = load || output == ""
+	} else {
+		export, err = LoadExport(input, tempdir)
+		if err != nil {
+			fatal(err)
+		}
+	}
 
 	// Export may have multiple branches with the same parent.
 	// We can't handle that currently so abort.
@@ -112,15 +281,51 @@ func main() {
 		start = export.Root()
 	}
 
-	if from != "" {
+	var baseTop *ExportedImage
+	if baseImage != "" {
+		base, err := LoadBaseImage(baseImage)
+		if err != nil {
+			fatal(err)
+		}
+
+		baseTop, err = export.MatchBase(base)
+		if err != nil {
+			fatal(err)
+		}
+		if baseTop == nil {
+			fatalf("image is not built on %s\n", baseImage)
+		}
+
+		debugf("Base image ends at layer %s\n", baseTop.LayerConfig.Id[0:12])
+		start = baseTop
+	}
 
-		if from == "root" {
-			start = export.Root()
-		} else {
-			start, err = export.GetById(from)
+	switch from {
+	case "":
+	case "auto":
+		model := &CostModel{
+			Shared:       map[string]bool{},
+			SharedWeight: sharedWeight,
+		}
+		for _, base := range shared {
+			ids, err := readLayerIds(base)
 			if err != nil {
 				fatal(err)
 			}
+			for id := range ids {
+				model.Shared[id] = true
+			}
+		}
+
+		start, err = export.AutoStart(model)
+		if err != nil {
+			fatal(err)
+		}
+		debugf("Selected squash point %s\n", start.LayerConfig.Id[0:12])
+	default:
+		start, err = export.Select(from)
+		if err != nil {
+			fatal(err)
 		}
 	}
 
@@ -129,22 +334,120 @@ func main() {
 		return
 	}
 
-	// extract each "layer.tar" to "layer" dir
-	err = export.ExtractLayers()
+	original := map[string]bool{}
+	for id := range export.Entries {
+		original[id] = true
+	}
+	if reproducible {
+		sourceDate, err = export.SourceDate()
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	ranges := []*SquashRange{{Start: start}}
+	if len(squash) > 0 || rangesFile != "" {
+		if from != "" || to != "" || layers > 0 {
+			fatal("-squash and -ranges cannot be combined with -from, -to or -layers")
+		}
+
+		ranges = []*SquashRange{}
+		for _, spec := range squash {
+			r, err := export.ParseRange(spec)
+			if err != nil {
+				fatal(err)
+			}
+			ranges = append(ranges, r)
+		}
+
+		if rangesFile != "" {
+			fileRanges, err := export.ReadRanges(rangesFile)
+			if err != nil {
+				fatal(err)
+			}
+			ranges = append(ranges, fileRanges...)
+		}
+
+		ranges, err = export.SortRanges(ranges)
+		if err != nil {
+			fatal(err)
+		}
+	} else if to != "" {
+		end, err := export.Select(to)
+		if err != nil {
+			fatal(err)
+		}
+		ranges[0].End = end
+
+		if _, err := export.Layers(ranges[0]); err != nil {
+			fatal(err)
+		}
+	}
+
+	if layers > 0 {
+		ranges, err = export.Partition(ranges[0], layers)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	if baseTop != nil {
+		err = export.CheckBase(baseTop, ranges)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	omit := map[string]bool{}
+	if thin {
+		unchanged := export.Unchanged(ranges)
+		// before extracting anything, so that a missing layer is found early
+		if knownFile != "" {
+			known, err := readKnownLayers(knownFile)
+			if err != nil {
+				fatal(err)
+			}
+
+			err = checkKnownLayers(unchanged, known)
+			if err != nil {
+				fatal(err)
+			}
+		}
+
+		for _, entry := range unchanged {
+			omit[filepath.Base(entry.Path)] = true
+		}
+		debugf("Leaving out %d unchanged layers\n", len(unchanged))
+	}
+
+	err = export.CheckDiskSpace()
 	if err != nil {
 		fatal(err)
-		return
 	}
 
-	// insert a new layer after our squash point
-	newEntry, err := export.InsertLayer(start.LayerConfig.Id)
+	// extract each "layer.tar" to "layer" dir
+	err = export.ExtractLayers()
 	if err != nil {
 		fatal(err)
 		return
 	}
 
-	debugf("Inserted new layer %s after %s\n", newEntry.LayerConfig.Id[0:12],
-		newEntry.LayerConfig.Parent[0:12])
+	// insert a new layer above each squash point, starting from the top so
+	// that the layers bounding lower ranges are not yet rewritten
+	inserted := map[string]bool{}
+	newEntries := make([]*ExportedImage, len(ranges))
+	for i := len(ranges) - 1; i >= 0; i-- {
+		newEntry, err := export.InsertLayer(ranges[i].Start.LayerConfig.Id)
+		if err != nil {
+			fatal(err)
+			return
+		}
+		newEntries[i] = newEntry
+		inserted[newEntry.LayerConfig.Id] = true
+
+		debugf("Inserted new layer %s after %s\n", newEntry.LayerConfig.Id[0:12],
+			newEntry.LayerConfig.Parent[0:12])
+	}
 
 	if verbose {
 		e := export.Root()
@@ -157,27 +460,49 @@ func main() {
 				cmd = cmd[:60]
 			}
 
-			if e.LayerConfig.Id == newEntry.LayerConfig.Id {
-				debugf("  -> %s %s\n", e.LayerConfig.Id[0:12], cmd)
+			if inserted[e.LayerConfig.Id] {
+				debugf("  -> %s %-8s %s\n", e.LayerConfig.Id[0:12], "squash", cmd)
 			} else {
-				debugf("  -  %s %s\n", e.LayerConfig.Id[0:12], cmd)
+				debugf("  -  %s %-8s %s\n", e.LayerConfig.Id[0:12], e.Classification(), cmd)
 			}
 			e = export.ChildOf(e.LayerConfig.Id)
 		}
 	}
 
-	// squash all later layers into our new layer
-	err = export.SquashLayers(newEntry, newEntry)
-	if err != nil {
-		fatal(err)
-		return
+	for i := len(ranges) - 1; i >= 0; i-- {
+		newEntry := newEntries[i]
+
+		// squash the layers of the range into our new layer
+		err = export.SquashLayers(newEntry, newEntry, ranges[i].End)
+		if err != nil {
+			fatal(err)
+			return
+		}
+
+		if dedupe {
+			linked, saved, err := newEntry.Dedupe(dedupeExcludes)
+			if err != nil {
+				fatal(err)
+			}
+			fmt.Fprintf(os.Stderr, "Deduplicated %d files in layer %s, saving %s\n", linked,
+				newEntry.LayerConfig.Id[:12], units.HumanSize(float64(saved)))
+		}
+
+		debugf("Tarring up squashed layer %s\n", newEntry.LayerConfig.Id[:12])
+		// create a layer.tar from our squashed layer
+		err = newEntry.TarLayer()
+		if err != nil {
+			fatal(err)
+		}
 	}
 
-	debugf("Tarring up squashed layer %s\n", newEntry.LayerConfig.Id[:12])
-	// create a layer.tar from our squashed layer
-	err = newEntry.TarLayer()
-	if err != nil {
-		fatal(err)
+	if estargz {
+		for _, newEntry := range newEntries {
+			err = newEntry.ConvertEstargz(priority)
+			if err != nil {
+				fatal(err)
+			}
+		}
 	}
 
 	debugf("Removing extracted layers\n")
@@ -187,6 +512,19 @@ func main() {
 		fatal(err)
 	}
 
+	err = export.RecordDiffIds(original)
+	if err != nil {
+		fatal(err)
+	}
+
+	if reproducible {
+		debugf("Assigning content IDs\n")
+		err = export.ReassignIds(original, chainIds)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
 	if tag != "" {
 		tagPart := "latest"
 		repoPart := tag
@@ -208,27 +546,69 @@ func main() {
 		}
 	}
 
-	ow := os.Stdout
-	if output != "" {
-		var err error
-		ow, err = os.Create(output)
+	if perLayer {
+		err = export.CompressLayers(omit, compression, compressLevel)
 		if err != nil {
 			fatal(err)
 		}
-		debugf("Tarring new image to %s\n", output)
-	} else {
-		debugf("Tarring new image to STDOUT\n")
+		compression = Uncompressed
 	}
-	// bundle up the new image
-	err = export.TarLayers(ow)
+
+	err = export.WriteManifest(omit)
 	if err != nil {
 		fatal(err)
 	}
 
+	if pushRef != nil {
+		digest, err := registry.Push(export, pulled, pushRef, compression, compressLevel)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Printf("Pushed %s@%s\n", pushRef, digest)
+	} else if load {
+		debugf("Loading new image into docker\n")
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(export.TarLayers(pw, omit))
+		}()
+
+		loaded, err := client.LoadImage(pr)
+		if err != nil {
+			fatal(err)
+		}
+		for _, l := range loaded {
+			fmt.Printf("Loaded %s\n", l)
+		}
+	} else {
+		ow := os.Stdout
+		if output != "" {
+			var err error
+			ow, err = os.Create(output)
+			if err != nil {
+				fatal(err)
+			}
+			debugf("Tarring new image to %s\n", output)
+		} else {
+			debugf("Tarring new image to STDOUT\n")
+		}
+		cw, err := compressStream(ow, compression, compressLevel)
+		if err != nil {
+			fatal(err)
+		}
+		// bundle up the new image
+		err = export.TarLayers(cw, omit)
+		if err != nil {
+			fatal(err)
+		}
+		err = cw.Close()
+		if err != nil {
+			fatal(err)
+		}
+	}
+
 	debug("Done. New image created.")
 	// print our new history
 	export.PrintHistory()
 
-	signals <- os.Interrupt
-	wg.Wait()
+	cleanup()
 }
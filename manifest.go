@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// historyOf returns the history entry of a layer in an image config.
+func historyOf(entry *ExportedImage) historyEntry {
+	return historyEntry{
+		Created:   entry.LayerConfig.Created.UTC().Format(time.RFC3339Nano),
+		CreatedBy: strings.Join(entry.LayerConfig.ContainerConfig().Cmd, " "),
+		Comment:   entry.LayerConfig.Comment,
+	}
+}
+
+// WriteManifest rewrites the manifest.json and image config written by
+// docker save since docker 1.10 for the squashed image, as docker load reads
+// them rather than the layer json.  The layers, diff_ids and history come
+// from the layer chain, and the rest of the config, such as the runtime
+// config of the image, is kept.  Layers that are metadata only are left out
+// of the layers, as docker save does, unless they were listed before.  The
+// image is tagged with the repositories naming its top layer.
+//
+// Exports without a manifest.json are left alone.  When layers are omitted
+// from the archive, the manifest.json and config are removed instead, and
+// docker load reads the layer json.
+func (e *Export) WriteManifest(omit map[string]bool) error {
+	manifestPath := filepath.Join(e.Path, "manifest.json")
+	manifests := []dockerManifest{}
+	err := readJsonFile(manifestPath, &manifests)
+	if err != nil || len(manifests) == 0 {
+		return err
+	}
+	if len(manifests) > 1 {
+		return errors.New(fmt.Sprintf("manifest.json has %d images. Expected one.", len(manifests)))
+	}
+	old := manifests[0]
+
+	if _, err := relativeName(old.Config); err != nil {
+		return &UnsafeEntryError{Name: old.Config, Reason: err.Error()}
+	}
+	oldConfigPath := filepath.Join(e.Path, old.Config)
+
+	if len(omit) > 0 {
+		debug("  -  Removing manifest.json of the thin archive")
+		if err := os.Remove(oldConfigPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Remove(manifestPath)
+	}
+
+	listed := map[string]bool{}
+	for _, layer := range old.Layers {
+		listed[e.layerId(layer)] = true
+	}
+
+	manifest := dockerManifest{RepoTags: []string{}, Layers: []string{}}
+	diffIds := []string{}
+	history := []historyEntry{}
+	for _, entry := range e.Chain() {
+		id := entry.LayerConfig.Id
+		h := historyOf(entry)
+		if listed[id] || !entry.MetadataOnly() {
+			diffId, err := entry.DiffId()
+			if err != nil {
+				return err
+			}
+			layer := id + "/layer.tar"
+			if link, err := os.Readlink(entry.LayerTarPath); err == nil {
+				layer = path.Join(id, link)
+			}
+			manifest.Layers = append(manifest.Layers, layer)
+			diffIds = append(diffIds, diffId)
+		} else {
+			h.EmptyLayer = true
+		}
+		history = append(history, h)
+	}
+
+	top := e.LastChild().LayerConfig.Id
+	for repo, tags := range e.Repositories {
+		for tag, id := range *tags {
+			if id == top {
+				manifest.RepoTags = append(manifest.RepoTags, repo+":"+tag)
+			}
+		}
+	}
+	sort.Strings(manifest.RepoTags)
+
+	config := map[string]json.RawMessage{}
+	if err := readJsonFile(oldConfigPath, &config); err != nil {
+		return err
+	}
+	for k, v := range map[string]interface{}{
+		"rootfs":  rootFS{Type: "layers", DiffIds: diffIds},
+		"history": history,
+	} {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		config[k] = b
+	}
+
+	configJson, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	manifest.Config = strings.TrimPrefix(digestOf(configJson), "sha256:") + ".json"
+
+	debugf("  -  Writing manifest.json with config %s\n", manifest.Config[:12])
+	if err := os.Remove(oldConfigPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(e.Path, manifest.Config), configJson, 0644); err != nil {
+		return err
+	}
+
+	manifestJson, err := json.Marshal([]dockerManifest{manifest})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(manifestPath, manifestJson, 0644)
+}
+
+// layerId returns the ID of the layer whose tar is at p in the export, as
+// listed by manifest.json: in the dir of the layer or, since docker 25, a
+// blob that the layer tar links to.
+func (e *Export) layerId(p string) string {
+	if path.Base(p) == "layer.tar" {
+		return path.Base(path.Dir(p))
+	}
+	if _, err := relativeName(p); err != nil {
+		return ""
+	}
+	fi, err := os.Stat(filepath.Join(e.Path, p))
+	if err != nil {
+		return ""
+	}
+	for id, entry := range e.Entries {
+		if efi, err := os.Stat(entry.LayerTarPath); err == nil && os.SameFile(fi, efi) {
+			return id
+		}
+	}
+	return ""
+}
+
+// CompressLayers compresses the layer tars of the export that aren't in
+// omit into blobs named after their digest, as docker save writes them since
+// docker 25, and links the layer tars to the blobs.  The layers are
+// compressed concurrently.  docker load decompresses them, and their
+// diff_ids stay the digests of the uncompressed tars.
+func (e *Export) CompressLayers(omit map[string]bool, c Compression, level int) error {
+	layers := []*ExportedImage{}
+	for _, entry := range e.Chain() {
+		if _, err := os.Stat(entry.LayerTarPath); err == nil && !omit[filepath.Base(entry.Path)] {
+			layers = append(layers, entry)
+		}
+	}
+
+	blobDir := filepath.Join(e.Path, "blobs", "sha256")
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		return err
+	}
+	debugf("Compressing %d layers with %s\n", len(layers), c)
+	descs, diffIds, err := compressLayers(layers, blobDir, "", "", c, level)
+	if err != nil {
+		return err
+	}
+
+	for i, entry := range layers {
+		// layers with the same content share a blob
+		blob := ociBlobPath(e.Path, descs[i].Digest)
+		if _, err := os.Stat(blob); os.IsNotExist(err) {
+			err = os.Rename(blobPath(blobDir, descs[i].Digest), blob)
+			if err != nil {
+				return err
+			}
+			if err := os.Chmod(blob, 0644); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(entry.LayerTarPath); err != nil {
+			return err
+		}
+		link, err := filepath.Rel(entry.Path, blob)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(link, entry.LayerTarPath); err != nil {
+			return err
+		}
+		entry.diffId = diffIds[i]
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompressLayers(t *testing.T) {
+	export := testExport(t,
+		[]testEntry{dirEntry("etc/", 0755), fileEntry("etc/passwd", "root:x:0:0::/root:/bin/sh\n")},
+		[]testEntry{dirEntry("etc/", 0755), fileEntry("etc/hosts", "127.0.0.1 localhost\n")},
+	)
+
+	diffIds := []string{}
+	for _, entry := range export.Chain() {
+		diffId, err := entry.DiffId()
+		if err != nil {
+			t.Fatal(err)
+		}
+		diffIds = append(diffIds, diffId)
+		entry.diffId = ""
+	}
+
+	config, err := json.Marshal(map[string]interface{}{"rootfs": rootFS{Type: "layers", DiffIds: diffIds}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(export.Path, "config.json"), config, 0644); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := json.Marshal([]dockerManifest{{Config: "config.json", Layers: []string{
+		export.Root().LayerConfig.Id + "/layer.tar",
+		export.LastChild().LayerConfig.Id + "/layer.tar",
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(export.Path, "manifest.json"), manifest, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := export.CompressLayers(nil, Gzip, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := export.WriteManifest(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	manifests := []dockerManifest{}
+	if err := readJsonFile(filepath.Join(export.Path, "manifest.json"), &manifests); err != nil {
+		t.Fatal(err)
+	}
+	for i, layer := range manifests[0].Layers {
+		b, err := ioutil.ReadFile(filepath.Join(export.Path, layer))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if detectCompression(b) != Gzip {
+			t.Errorf("layer %s is not compressed", layer)
+		}
+		sum := sha256.Sum256(b)
+		if want := "blobs/sha256/" + hex.EncodeToString(sum[:]); layer != want {
+			t.Errorf("layer %d is %s, want %s", i, layer, want)
+		}
+	}
+
+	written := &ociConfig{}
+	if err := readJsonFile(filepath.Join(export.Path, manifests[0].Config), written); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(written.RootFS.DiffIds, " "); got != strings.Join(diffIds, " ") {
+		t.Errorf("config has diff_ids %s, want the uncompressed %s", got, strings.Join(diffIds, " "))
+	}
+
+	for _, entry := range export.Chain() {
+		entry.diffId = ""
+	}
+	if err := export.Check(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// SquashRange is a run of layers squashed into a single new layer inserted
+// above Start.  End is the last layer squashed, or nil for the top of the
+// image.
+type SquashRange struct {
+	Start *ExportedImage
+	End   *ExportedImage
+}
+
+// Layers returns the layers of a range, from the first layer above Start to
+// End.
+func (e *Export) Layers(r *SquashRange) ([]*ExportedImage, error) {
+	chain := e.Chain()
+	base := -1
+	for i, entry := range chain {
+		if entry == r.Start {
+			base = i
+		}
+	}
+	if base == -1 {
+		return nil, errors.New(fmt.Sprintf("%s is not in the image", r.Start.LayerConfig.Id[:12]))
+	}
+
+	if r.End == nil {
+		return chain[base+1:], nil
+	}
+
+	for i := base + 1; i < len(chain); i++ {
+		if chain[i] == r.End {
+			return chain[base+1 : i+1], nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("%s is not above %s", r.End.LayerConfig.Id[:12],
+		r.Start.LayerConfig.Id[:12]))
+}
+
+// Partition splits the layers of a range into n contiguous ranges, choosing
+// the boundaries that minimize the total size of the squashed layers.
+func (e *Export) Partition(r *SquashRange, n int) ([]*SquashRange, error) {
+	layers, err := e.Layers(r)
+	if err != nil {
+		return nil, err
+	}
+
+	start := r.Start
+	if n < 1 || n > len(layers) {
+		return nil, errors.New(fmt.Sprintf("cannot squash %d layers above %s into %d layers",
+			len(layers), start.LayerConfig.Id[:12], n))
+	}
+
+	// content[j] is the number of layers up to j that aren't metadata only.
+	// Every range must hold at least one, or an empty layer would cost less
+	// than any split of the content layers.
+	entries := make([][]*layerEntry, len(layers))
+	content := make([]int, len(layers))
+	for i, entry := range layers {
+		entries[i], err = readLayerEntries(entry.LayerTarPath, false)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			content[i] = content[i-1]
+		}
+		if !entry.MetadataOnly() {
+			content[i]++
+		}
+	}
+	if n > content[len(layers)-1] {
+		return nil, errors.New(fmt.Sprintf("cannot squash %d layers above %s into %d layers: only %d of them change files",
+			len(layers), start.LayerConfig.Id[:12], n, content[len(layers)-1]))
+	}
+
+	// size[i][j] is the estimated size of squashing layers i to j.
+	size := make([][]int64, len(layers))
+	for i := range layers {
+		size[i] = make([]int64, len(layers))
+		fi := FileIndex{}
+		total := int64(2 * tarBlockSize)
+		for j := i; j < len(layers); j++ {
+			for _, c := range fi.apply(layers[j].LayerConfig.Id, entries[j]) {
+				for _, r := range c.Replaced {
+					total -= tarSize(r)
+				}
+				if c.Kind != ChangeDelete {
+					total += tarSize(fi[c.Path])
+				}
+			}
+			for _, le := range entries[j] {
+				if _, _, ok := le.whiteout(); ok {
+					total += tarBlockSize
+				}
+			}
+			size[i][j] = total
+		}
+	}
+
+	// best[g][j] is the smallest total size of squashing layers 0 to j into
+	// g+1 ranges, and split[g][j] the first layer of the last of them.
+	best := make([][]int64, n)
+	split := make([][]int, n)
+	for g := 0; g < n; g++ {
+		best[g] = make([]int64, len(layers))
+		split[g] = make([]int, len(layers))
+		for j := range layers {
+			best[g][j] = -1
+			if g == 0 {
+				if content[j] > 0 {
+					best[g][j] = size[0][j]
+				}
+				continue
+			}
+			for i := g; i <= j; i++ {
+				if best[g-1][i-1] < 0 || content[j] == content[i-1] {
+					continue
+				}
+				total := best[g-1][i-1] + size[i][j]
+				if best[g][j] < 0 || total < best[g][j] {
+					best[g][j] = total
+					split[g][j] = i
+				}
+			}
+		}
+	}
+
+	ranges := make([]*SquashRange, n)
+	j := len(layers) - 1
+	for g := n - 1; g >= 0; g-- {
+		i := split[g][j]
+		ranges[g] = &SquashRange{Start: start, End: layers[j]}
+		if i > 0 {
+			ranges[g].Start = layers[i-1]
+		}
+		j = i - 1
+	}
+	ranges[n-1].End = r.End
+
+	return ranges, nil
+}
+
+// ParseRange parses a range given as "from..to".  Both ends are layer
+// selectors as accepted by -from and -to.  An empty "to" squashes to the top of the
+// image.
+func (e *Export) ParseRange(spec string) (*SquashRange, error) {
+	parts := strings.SplitN(spec, "..", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, errors.New(fmt.Sprintf("bad range format: %s", spec))
+	}
+
+	start, err := e.Select(parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	r := &SquashRange{Start: start}
+	if parts[1] != "" {
+		r.End, err = e.Select(parts[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// ReadRanges reads ranges from a file with one "from..to" range per line.
+// Empty lines and lines starting with # are ignored.
+func (e *Export) ReadRanges(file string) ([]*SquashRange, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ranges := []*SquashRange{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		r, err := e.ParseRange(line)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, scanner.Err()
+}
+
+// SortRanges orders ranges from the root of the image and checks that no
+// two of them squash the same layer.
+func (e *Export) SortRanges(ranges []*SquashRange) ([]*SquashRange, error) {
+	position := map[*ExportedImage]int{}
+	for i, entry := range e.Chain() {
+		position[entry] = i
+	}
+
+	sorted := make([]*SquashRange, len(ranges))
+	copy(sorted, ranges)
+	sort.Sort(rangesByStart{sorted, position})
+
+	for i, r := range sorted {
+		layers, err := e.Layers(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(layers) == 0 {
+			return nil, errors.New(fmt.Sprintf("%s has no layers above it to squash",
+				r.Start.LayerConfig.Id[:12]))
+		}
+
+		if i == 0 {
+			continue
+		}
+		prev := sorted[i-1]
+		if prev.End == nil || position[prev.End] > position[r.Start] {
+			return nil, errors.New(fmt.Sprintf("ranges from %s and %s overlap",
+				prev.Start.LayerConfig.Id[:12], r.Start.LayerConfig.Id[:12]))
+		}
+	}
+	return sorted, nil
+}
+
+type rangesByStart struct {
+	ranges   []*SquashRange
+	position map[*ExportedImage]int
+}
+
+func (r rangesByStart) Len() int      { return len(r.ranges) }
+func (r rangesByStart) Swap(i, j int) { r.ranges[i], r.ranges[j] = r.ranges[j], r.ranges[i] }
+func (r rangesByStart) Less(i, j int) bool {
+	return r.position[r.ranges[i].Start] < r.position[r.ranges[j].Start]
+}
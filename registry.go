@@ -0,0 +1,906 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mediaTypeManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeConfig       = "application/vnd.docker.container.image.v1+json"
+	mediaTypeLayer        = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	mediaTypeOCIManifest  = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex     = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIConfig    = "application/vnd.oci.image.config.v1+json"
+	mediaTypeOCILayer     = "application/vnd.oci.image.layer.v1.tar+gzip"
+	mediaTypeOCILayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+)
+
+// RegistryRef is an image in a registry, given as
+// registry://host/repository:tag or registry://host/repository@digest.
+type RegistryRef struct {
+	Host string
+	Repo string
+	Tag  string
+}
+
+func (r *RegistryRef) String() string {
+	if strings.HasPrefix(r.Tag, "sha256:") {
+		return fmt.Sprintf("%s/%s@%s", r.Host, r.Repo, r.Tag)
+	}
+	return fmt.Sprintf("%s/%s:%s", r.Host, r.Repo, r.Tag)
+}
+
+// ParseRegistryRef parses a registry:// image reference.
+func ParseRegistryRef(s string) (*RegistryRef, error) {
+	if !strings.HasPrefix(s, "registry://") {
+		return nil, errors.New(fmt.Sprintf("bad registry reference: %s", s))
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(s, "registry://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, errors.New(fmt.Sprintf("bad registry reference: %s", s))
+	}
+
+	ref := &RegistryRef{Host: parts[0], Repo: parts[1], Tag: "latest"}
+	if i := strings.Index(ref.Repo, "@"); i != -1 {
+		ref.Repo, ref.Tag = ref.Repo[:i], ref.Repo[i+1:]
+	} else if i := strings.LastIndex(ref.Repo, ":"); i != -1 {
+		ref.Repo, ref.Tag = ref.Repo[:i], ref.Repo[i+1:]
+	}
+
+	if ref.Repo == "" || ref.Tag == "" {
+		return nil, errors.New(fmt.Sprintf("bad registry reference: %s", s))
+	}
+	return ref, nil
+}
+
+type historyEntry struct {
+	Created    string `json:"created,omitempty"`
+	CreatedBy  string `json:"created_by,omitempty"`
+	Comment    string `json:"comment,omitempty"`
+	EmptyLayer bool   `json:"empty_layer,omitempty"`
+}
+
+type rootFS struct {
+	Type    string   `json:"type"`
+	DiffIds []string `json:"diff_ids"`
+}
+
+type imageConfig struct {
+	Config  *Config        `json:"config"`
+	History []historyEntry `json:"history"`
+	RootFS  rootFS         `json:"rootfs"`
+}
+
+// PulledImage is an image pulled from a registry into an export.
+type PulledImage struct {
+	Ref     *RegistryRef
+	OCI     bool
+	Config  map[string]json.RawMessage
+	BlobDir string
+
+	// Layers are the blobs and DiffIds the digests of the uncompressed
+	// tars of the pulled layers, by layer id.
+	Layers  map[string]ociDescriptor
+	DiffIds map[string]string
+}
+
+// RegistryClient talks to registries over the Distribution HTTP API.
+type RegistryClient struct {
+	client *http.Client
+	auths  map[string]string
+	tokens map[string]string
+}
+
+// NewRegistryClient returns a client using the credentials stored by
+// docker login in ~/.docker/config.json.
+func NewRegistryClient() (*RegistryClient, error) {
+	auths, err := loadDockerAuths()
+	if err != nil {
+		return nil, err
+	}
+
+	return &RegistryClient{
+		client: &http.Client{},
+		auths:  auths,
+		tokens: map[string]string{},
+	}, nil
+}
+
+// loadDockerAuths returns the base64 encoded user:password of each registry
+// host in the docker config file.
+func loadDockerAuths() (map[string]string, error) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+
+	config := struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}{}
+	err := readJsonFile(filepath.Join(dir, "config.json"), &config)
+	if err != nil {
+		return nil, err
+	}
+
+	auths := map[string]string{}
+	for key, auth := range config.Auths {
+		host := key
+		if u, err := url.Parse(key); err == nil && u.Host != "" {
+			host = u.Host
+		}
+		if host == "index.docker.io" {
+			host = "registry-1.docker.io"
+		}
+		auths[host] = auth.Auth
+	}
+	return auths, nil
+}
+
+func registryURL(host string) string {
+	hostname := strings.Split(host, ":")[0]
+	if hostname == "localhost" || hostname == "127.0.0.1" {
+		return "http://" + host
+	}
+	return "https://" + host
+}
+
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// registryAuth is the Authorization header for requests to host with the
+// given token scopes.  Header is empty for registries without auth.
+type registryAuth struct {
+	host   string
+	scopes []string
+	header string
+}
+
+// authorize returns the authorization for requests to host with the given
+// token scopes.
+func (c *RegistryClient) authorize(host string, scopes ...string) (*registryAuth, error) {
+	auth := &registryAuth{host: host, scopes: scopes}
+	if err := c.renew(auth, false); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// renew sets the Authorization header of auth, answering the registry's
+// auth challenge.  Headers are cached for the run unless expired is set,
+// when the registry rejected the cached one.
+func (c *RegistryClient) renew(auth *registryAuth, expired bool) error {
+	key := auth.host + " " + strings.Join(auth.scopes, " ")
+	if header, ok := c.tokens[key]; ok && !expired {
+		auth.header = header
+		return nil
+	}
+
+	header, err := c.challenge(auth.host, auth.scopes)
+	if err != nil {
+		return err
+	}
+	c.tokens[key] = header
+	auth.header = header
+	return nil
+}
+
+// challenge returns the Authorization header for requests to host with the
+// given token scopes, answering the registry's auth challenge.
+func (c *RegistryClient) challenge(host string, scopes []string) (string, error) {
+	resp, err := c.client.Get(registryURL(host) + "/v2/")
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	auth := ""
+	challenge := resp.Header.Get("WWW-Authenticate")
+	switch {
+	case resp.StatusCode != http.StatusUnauthorized:
+	case strings.HasPrefix(strings.ToLower(challenge), "basic"):
+		if c.auths[host] == "" {
+			return "", errors.New(fmt.Sprintf("%s requires a login", host))
+		}
+		auth = "Basic " + c.auths[host]
+	case strings.HasPrefix(strings.ToLower(challenge), "bearer"):
+		params := map[string]string{}
+		for _, m := range challengeParam.FindAllStringSubmatch(challenge, -1) {
+			params[m[1]] = m[2]
+		}
+
+		query := url.Values{}
+		if params["service"] != "" {
+			query.Set("service", params["service"])
+		}
+		for _, scope := range scopes {
+			query.Add("scope", scope)
+		}
+
+		req, err := http.NewRequest("GET", params["realm"]+"?"+query.Encode(), nil)
+		if err != nil {
+			return "", err
+		}
+		if c.auths[host] != "" {
+			req.Header.Set("Authorization", "Basic "+c.auths[host])
+		}
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", errors.New(fmt.Sprintf("token request for %s failed: %s", host, resp.Status))
+		}
+
+		token := struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+			return "", err
+		}
+		if token.Token == "" {
+			token.Token = token.AccessToken
+		}
+		auth = "Bearer " + token.Token
+	default:
+		return "", errors.New(fmt.Sprintf("%s: unsupported auth challenge %q", host, challenge))
+	}
+
+	return auth, nil
+}
+
+// do sends a request with auth.  Tokens expire, so a request rejected with
+// 401 is sent once more with a fresh token, the body rewound.
+func (c *RegistryClient) do(method, u string, auth *registryAuth, header http.Header, body io.ReadSeeker, length int64) (*http.Response, error) {
+	for retried := false; ; retried = true {
+		var r io.Reader
+		if body != nil {
+			if _, err := body.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			// keep the client from closing files that may be sent again
+			r = ioutil.NopCloser(body)
+		}
+
+		req, err := http.NewRequest(method, u, r)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if auth.header != "" {
+			req.Header.Set("Authorization", auth.header)
+		}
+		if body != nil {
+			req.ContentLength = length
+		}
+
+		resp, err := c.client.Do(req)
+		if err != nil || resp.StatusCode != http.StatusUnauthorized || retried {
+			return resp, err
+		}
+		resp.Body.Close()
+
+		debugf("  -  Authorization for %s was rejected, renewing it\n", auth.host)
+		if err := c.renew(auth, true); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func registryError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	msg := struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}{}
+	if err := json.Unmarshal(body, &msg); err == nil && len(msg.Errors) > 0 {
+		return errors.New(fmt.Sprintf("%s %s: %s", resp.Request.Method, resp.Request.URL.Path,
+			msg.Errors[0].Message))
+	}
+	return errors.New(fmt.Sprintf("%s %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status))
+}
+
+func (c *RegistryClient) getManifest(ref *RegistryRef, reference string, auth *registryAuth) ([]byte, string, error) {
+	header := http.Header{}
+	header.Set("Accept", strings.Join([]string{mediaTypeManifest, mediaTypeManifestList,
+		mediaTypeOCIManifest, mediaTypeOCIIndex}, ", "))
+
+	resp, err := c.do("GET", fmt.Sprintf("%s/v2/%s/manifests/%s", registryURL(ref.Host), ref.Repo,
+		reference), auth, header, nil, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", registryError(resp)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	return body, resp.Header.Get("Content-Type"), err
+}
+
+// fetchBlob writes a blob to w and checks its digest.
+func (c *RegistryClient) fetchBlob(ref *RegistryRef, digest string, auth *registryAuth, w io.Writer) error {
+	resp, err := c.do("GET", fmt.Sprintf("%s/v2/%s/blobs/%s", registryURL(ref.Host), ref.Repo, digest),
+		auth, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return registryError(resp)
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, h), resp.Body); err != nil {
+		return err
+	}
+
+	if actual := "sha256:" + hex.EncodeToString(h.Sum(nil)); actual != digest {
+		return errors.New(fmt.Sprintf("blob %s has digest %s", digest, actual))
+	}
+	return nil
+}
+
+// Pull downloads an image into an export at location.  The compressed
+// layer blobs are kept in blobDir so that they can be pushed again.
+func (c *RegistryClient) Pull(ref *RegistryRef, location, blobDir string) (*Export, *PulledImage, error) {
+	debugf("Pulling %s using %s for tempdir\n", ref, location)
+
+	auth, err := c.authorize(ref.Host, "repository:"+ref.Repo+":pull")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body, mediaType, err := c.getManifest(ref, ref.Tag, auth)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if mediaType == mediaTypeManifestList || mediaType == mediaTypeOCIIndex {
+		index := &ociIndex{}
+		if err := json.Unmarshal(body, index); err != nil {
+			return nil, nil, err
+		}
+
+		digest := ""
+		for _, m := range index.Manifests {
+			if m.Platform == nil || (m.Platform.OS == "linux" && m.Platform.Architecture == runtime.GOARCH) {
+				digest = m.Digest
+				break
+			}
+		}
+		if digest == "" {
+			return nil, nil, errors.New(fmt.Sprintf("%s has no linux/%s image", ref, runtime.GOARCH))
+		}
+
+		body, mediaType, err = c.getManifest(ref, digest, auth)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	manifest := &ociManifest{}
+	if err := json.Unmarshal(body, manifest); err != nil {
+		return nil, nil, err
+	}
+
+	configJson := &strings.Builder{}
+	if err := c.fetchBlob(ref, manifest.Config.Digest, auth, configJson); err != nil {
+		return nil, nil, err
+	}
+
+	pulled := &PulledImage{
+		Ref:     ref,
+		OCI:     mediaType == mediaTypeOCIManifest,
+		Config:  map[string]json.RawMessage{},
+		BlobDir: blobDir,
+		Layers:  map[string]ociDescriptor{},
+		DiffIds: map[string]string{},
+	}
+	if err := json.Unmarshal([]byte(configJson.String()), &pulled.Config); err != nil {
+		return nil, nil, err
+	}
+
+	config := &imageConfig{}
+	if err := json.Unmarshal([]byte(configJson.String()), config); err != nil {
+		return nil, nil, err
+	}
+
+	if len(config.RootFS.DiffIds) != len(manifest.Layers) {
+		return nil, nil, errors.New(fmt.Sprintf("%s has %d layers and %d diff_ids", ref,
+			len(manifest.Layers), len(config.RootFS.DiffIds)))
+	}
+
+	if limits.Layers > 0 && len(manifest.Layers) > limits.Layers {
+		return nil, nil, &LimitError{Limit: "layer count", Value: int64(len(manifest.Layers)), Max: int64(limits.Layers)}
+	}
+	blobSize := int64(0)
+	for _, desc := range manifest.Layers {
+		blobSize += desc.Size
+	}
+	if err := checkFreeSpace(filepath.Dir(location), blobSize); err != nil {
+		return nil, nil, err
+	}
+
+	history := config.History
+	if len(history) == 0 {
+		for range manifest.Layers {
+			history = append(history, historyEntry{})
+		}
+	}
+
+	export := &Export{
+		Entries:      map[string]*ExportedImage{},
+		Repositories: map[string]*TagInfo{},
+		Path:         location,
+	}
+	for _, dir := range []string{location, blobDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	parent, layer := "", 0
+	for _, h := range history {
+		var desc ociDescriptor
+		key := h.CreatedBy
+		if !h.EmptyLayer {
+			if layer == len(manifest.Layers) {
+				return nil, nil, errors.New(fmt.Sprintf("%s has more history than layers", ref))
+			}
+			desc = manifest.Layers[layer]
+			key = config.RootFS.DiffIds[layer]
+		}
+
+		sum := sha256.Sum256([]byte(parent + " " + key))
+		id := hex.EncodeToString(sum[:])
+
+		entry := &ExportedImage{
+			Path:         filepath.Join(location, id),
+			JsonPath:     filepath.Join(location, id, "json"),
+			VersionPath:  filepath.Join(location, id, "VERSION"),
+			LayerTarPath: filepath.Join(location, id, "layer.tar"),
+			LayerDirPath: filepath.Join(location, id, "layer"),
+			LayerConfig:  newLayerConfig(id, parent, h.Comment),
+		}
+		entry.LayerConfig.ContainerConfig().Cmd = []string{h.CreatedBy}
+		entry.LayerConfig.Config = config.Config
+		if created, err := time.Parse(time.RFC3339Nano, h.Created); err == nil {
+			entry.LayerConfig.Created = created
+		}
+
+		if err := entry.CreateDirs(); err != nil {
+			return nil, nil, err
+		}
+
+		if h.EmptyLayer {
+			err = writeEmptyTar(entry.LayerTarPath)
+		} else {
+			debugf("  -  Pulling %s\n", desc.Digest)
+			err = c.pullLayer(ref, auth, desc, blobPath(blobDir, desc.Digest), entry.LayerTarPath,
+				config.RootFS.DiffIds[layer])
+			pulled.Layers[id] = desc
+			pulled.DiffIds[id] = config.RootFS.DiffIds[layer]
+			layer++
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err := entry.WriteJson(); err != nil {
+			return nil, nil, err
+		}
+		if err := entry.WriteVersion(); err != nil {
+			return nil, nil, err
+		}
+
+		export.Entries[id] = entry
+		parent = id
+	}
+
+	if layer != len(manifest.Layers) {
+		return nil, nil, errors.New(fmt.Sprintf("%s has more layers than history", ref))
+	}
+
+	debugf("Pulled image w/ %d layers\n", len(export.Entries))
+	return export, pulled, nil
+}
+
+// pullLayer downloads a layer blob to blobPath and decompresses it to
+// tarPath, checking the digest of the uncompressed tar against diffId.
+func (c *RegistryClient) pullLayer(ref *RegistryRef, auth *registryAuth, desc ociDescriptor, blobPath, tarPath, diffId string) error {
+	blob, err := os.Create(blobPath)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	if err := c.fetchBlob(ref, desc.Digest, auth, blob); err != nil {
+		return err
+	}
+	if _, err := blob.Seek(0, 0); err != nil {
+		return err
+	}
+
+	r, err := decompressStream(blob)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.Create(tarPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		return err
+	}
+
+	if actual := "sha256:" + hex.EncodeToString(h.Sum(nil)); actual != diffId {
+		return errors.New(fmt.Sprintf("layer %s has diff_id %s, expected %s", desc.Digest, actual, diffId))
+	}
+	return nil
+}
+
+func writeEmptyTar(p string) error {
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return tar.NewWriter(f).Close()
+}
+
+// Push uploads the layers of an export that the registry doesn't have yet,
+// and a manifest and config for them, tagged as dst.  Blobs of layers left
+// unchanged since the pull are mounted from the source repository when it is
+// on the same registry.  The digest of the manifest is returned.
+func (c *RegistryClient) Push(export *Export, pulled *PulledImage, dst *RegistryRef, compression Compression, level int) (string, error) {
+	debugf("Pushing %s\n", dst)
+
+	mountFrom := ""
+	scopes := []string{"repository:" + dst.Repo + ":pull,push"}
+	if pulled.Ref.Host == dst.Host && pulled.Ref.Repo != dst.Repo {
+		mountFrom = pulled.Ref.Repo
+		scopes = append(scopes, "repository:"+mountFrom+":pull")
+	}
+
+	auth, err := c.authorize(dst.Host, scopes...)
+	if err != nil {
+		return "", err
+	}
+
+	layerType, configType, manifestType := mediaTypeLayer, mediaTypeConfig, mediaTypeManifest
+	if pulled.OCI {
+		layerType, configType, manifestType = mediaTypeOCILayer, mediaTypeOCIConfig, mediaTypeOCIManifest
+	}
+	gzipType := layerType
+	switch compression {
+	case Uncompressed:
+		compression = Gzip
+	case Zstd:
+		if !pulled.OCI {
+			return "", errors.New(fmt.Sprintf("%s is not an OCI image. zstd layers need an OCI manifest", pulled.Ref))
+		}
+		layerType = mediaTypeOCILayerZstd
+	}
+
+	changed := []*ExportedImage{}
+	for _, entry := range export.Chain() {
+		if _, ok := pulled.Layers[entry.LayerConfig.Id]; !ok && !entry.MetadataOnly() {
+			changed = append(changed, entry)
+		}
+	}
+	descs, changedDiffIds, err := compressLayers(changed, pulled.BlobDir, layerType, gzipType, compression, level)
+	if err != nil {
+		return "", err
+	}
+
+	manifest := &ociManifest{SchemaVersion: 2, MediaType: manifestType}
+	diffIds := []string{}
+	history := []historyEntry{}
+	for _, entry := range export.Chain() {
+		h := historyOf(entry)
+
+		if desc, ok := pulled.Layers[entry.LayerConfig.Id]; ok {
+			err := c.pushBlob(dst, auth, desc, blobPath(pulled.BlobDir, desc.Digest), mountFrom)
+			if err != nil {
+				return "", err
+			}
+			manifest.Layers = append(manifest.Layers, desc)
+			diffIds = append(diffIds, pulled.DiffIds[entry.LayerConfig.Id])
+		} else if entry.MetadataOnly() {
+			h.EmptyLayer = true
+		} else {
+			desc := descs[0]
+			err := c.pushBlob(dst, auth, desc, blobPath(pulled.BlobDir, desc.Digest), "")
+			if err != nil {
+				return "", err
+			}
+			manifest.Layers = append(manifest.Layers, desc)
+			diffIds = append(diffIds, changedDiffIds[0])
+			descs, changedDiffIds = descs[1:], changedDiffIds[1:]
+		}
+		history = append(history, h)
+	}
+
+	config := map[string]json.RawMessage{}
+	for k, v := range pulled.Config {
+		config[k] = v
+	}
+	for k, v := range map[string]interface{}{
+		"rootfs":  rootFS{Type: "layers", DiffIds: diffIds},
+		"history": history,
+	} {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		config[k] = b
+	}
+
+	configJson, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	manifest.Config = ociDescriptor{
+		MediaType: configType,
+		Digest:    digestOf(configJson),
+		Size:      int64(len(configJson)),
+	}
+
+	configPath := blobPath(pulled.BlobDir, manifest.Config.Digest)
+	if err := ioutil.WriteFile(configPath, configJson, 0644); err != nil {
+		return "", err
+	}
+	if err := c.pushBlob(dst, auth, manifest.Config, configPath, ""); err != nil {
+		return "", err
+	}
+
+	manifestJson, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", manifestType)
+	resp, err := c.do("PUT", fmt.Sprintf("%s/v2/%s/manifests/%s", registryURL(dst.Host), dst.Repo, dst.Tag),
+		auth, header, strings.NewReader(string(manifestJson)), int64(len(manifestJson)))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", registryError(resp)
+	}
+	return digestOf(manifestJson), nil
+}
+
+// pushBlob uploads the blob at p unless the repository already has it.
+// With mountFrom, the registry is first asked to mount the blob from that
+// repository instead.
+func (c *RegistryClient) pushBlob(ref *RegistryRef, auth *registryAuth, desc ociDescriptor, p, mountFrom string) error {
+	base := registryURL(ref.Host)
+	resp, err := c.do("HEAD", fmt.Sprintf("%s/v2/%s/blobs/%s", base, ref.Repo, desc.Digest), auth, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		debugf("  -  %s exists\n", desc.Digest)
+		return nil
+	}
+
+	u := fmt.Sprintf("%s/v2/%s/blobs/uploads/", base, ref.Repo)
+	if mountFrom != "" {
+		u += "?" + url.Values{"mount": {desc.Digest}, "from": {mountFrom}}.Encode()
+	}
+	resp, err = c.do("POST", u, auth, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		debugf("  -  %s mounted from %s\n", desc.Digest, mountFrom)
+		return nil
+	case http.StatusAccepted:
+	default:
+		return registryError(resp)
+	}
+
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return err
+	}
+	query := location.Query()
+	query.Set("digest", desc.Digest)
+	location.RawQuery = query.Encode()
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	debugf("  -  Uploading %s\n", desc.Digest)
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	resp, err = c.do("PUT", location.String(), auth, header, f, desc.Size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return registryError(resp)
+	}
+	return nil
+}
+
+// compressLayer compresses a layer tar into blobDir, named after its digest,
+// and returns its descriptor and the digest of the uncompressed tar.
+func compressLayer(tarPath, blobDir, mediaType string, c Compression, level int) (ociDescriptor, string, error) {
+	desc := ociDescriptor{MediaType: mediaType}
+
+	in, err := openLayerTar(tarPath)
+	if err != nil {
+		return desc, "", err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(blobDir, "layer")
+	if err != nil {
+		return desc, "", err
+	}
+	defer out.Close()
+
+	compressed := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(out, compressed)}
+	cw, err := compressStream(counter, c, level)
+	if err != nil {
+		return desc, "", err
+	}
+
+	uncompressed := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(cw, uncompressed), in); err != nil {
+		cw.Close()
+		return desc, "", err
+	}
+	if err := cw.Close(); err != nil {
+		return desc, "", err
+	}
+
+	desc.Digest = hashDigest(compressed)
+	desc.Size = counter.n
+	return desc, hashDigest(uncompressed), os.Rename(out.Name(), blobPath(blobDir, desc.Digest))
+}
+
+// storeLayer copies a compressed layer tar into blobDir, named after its
+// digest, and returns its descriptor and the digest of the uncompressed tar.
+func storeLayer(entry *ExportedImage, blobDir, mediaType string) (ociDescriptor, string, error) {
+	desc := ociDescriptor{MediaType: mediaType, Annotations: entry.Annotations}
+
+	in, err := os.Open(entry.LayerTarPath)
+	if err != nil {
+		return desc, "", err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(blobDir, "layer")
+	if err != nil {
+		return desc, "", err
+	}
+	defer out.Close()
+
+	h := sha256.New()
+	desc.Size, err = io.Copy(io.MultiWriter(out, h), in)
+	if err != nil {
+		return desc, "", err
+	}
+	desc.Digest = hashDigest(h)
+
+	diffId, err := entry.DiffId()
+	if err != nil {
+		return desc, "", err
+	}
+	return desc, diffId, os.Rename(out.Name(), blobPath(blobDir, desc.Digest))
+}
+
+// compressLayers compresses the tars of the layers concurrently.  Layers
+// already stored as eStargz are copied as gzip blobs.
+func compressLayers(layers []*ExportedImage, blobDir, mediaType, gzipType string, c Compression, level int) ([]ociDescriptor, []string, error) {
+	descs := make([]ociDescriptor, len(layers))
+	diffIds := make([]string, len(layers))
+	errs := make([]error, len(layers))
+
+	var wg sync.WaitGroup
+	sem := make(chan bool, runtime.NumCPU())
+	for i, entry := range layers {
+		wg.Add(1)
+		go func(i int, entry *ExportedImage) {
+			defer wg.Done()
+			sem <- true
+			defer func() { <-sem }()
+
+			if entry.Annotations != nil {
+				descs[i], diffIds[i], errs[i] = storeLayer(entry, blobDir, gzipType)
+				return
+			}
+			debugf("  -  Compressing layer %s\n", entry.LayerConfig.Id[:12])
+			descs[i], diffIds[i], errs[i] = compressLayer(entry.LayerTarPath, blobDir, mediaType, c, level)
+			if errs[i] == nil && entry.diffId != "" && entry.diffId != diffIds[i] {
+				errs[i] = errors.New(fmt.Sprintf("layer %s has diff_id %s, expected %s. It changed since it was written",
+					entry.LayerConfig.Id[:12], diffIds[i], entry.diffId))
+			}
+		}(i, entry)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return descs, diffIds, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func hashDigest(h hash.Hash) string {
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+func digestOf(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// blobPath returns the file a blob is kept in.
+func blobPath(blobDir, digest string) string {
+	return filepath.Join(blobDir, strings.Replace(digest, ":", "-", 1))
+}
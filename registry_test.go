@@ -0,0 +1,334 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testTar returns a tar archive of regular files, in name order.
+func testTar(files map[string]string) []byte {
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	b := &bytes.Buffer{}
+	t := tar.NewWriter(b)
+	for _, name := range names {
+		t.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg})
+		t.Write([]byte(files[name]))
+	}
+	t.Close()
+	return b.Bytes()
+}
+
+func gzipped(b []byte) []byte {
+	out := &bytes.Buffer{}
+	w := gzip.NewWriter(out)
+	w.Write(b)
+	w.Close()
+	return out.Bytes()
+}
+
+// fakeRegistry is a Distribution API registry asking for bearer tokens,
+// issued by its token endpoint to the user "user".
+type fakeRegistry struct {
+	sync.Mutex
+	url       string
+	blobs     map[string][]byte
+	repoBlobs map[string]bool // repo@digest
+	manifests map[string][]byte
+	tokens    map[string]bool
+	noMount   map[string]bool
+
+	issued, mounts, uploads int
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	r := &fakeRegistry{
+		blobs:     map[string][]byte{},
+		repoBlobs: map[string]bool{},
+		manifests: map[string][]byte{},
+		tokens:    map[string]bool{},
+		noMount:   map[string]bool{},
+	}
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	r.url = srv.URL
+	return r
+}
+
+func (r *fakeRegistry) host() string {
+	return strings.TrimPrefix(r.url, "http://")
+}
+
+// addBlob stores b in repo and returns its digest.
+func (r *fakeRegistry) addBlob(repo string, b []byte) string {
+	digest := digestOf(b)
+	r.blobs[digest] = b
+	r.repoBlobs[repo+"@"+digest] = true
+	return digest
+}
+
+// expire invalidates the tokens issued so far.
+func (r *fakeRegistry) expire() {
+	r.Lock()
+	defer r.Unlock()
+	r.tokens = map[string]bool{}
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+
+	if req.URL.Path == "/token" {
+		if req.Header.Get("Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		r.issued++
+		token := fmt.Sprintf("token%d", r.issued)
+		r.tokens[token] = true
+		json.NewEncoder(w).Encode(map[string]string{"token": token})
+		return
+	}
+
+	if !r.tokens[strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")] {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake"`, r.url))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	p := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case strings.Contains(p, "/manifests/"):
+		parts := strings.SplitN(p, "/manifests/", 2)
+		key := parts[0] + ":" + parts[1]
+		if req.Method == "PUT" {
+			r.manifests[key], _ = ioutil.ReadAll(req.Body)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		if r.manifests[key] == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", mediaTypeManifest)
+		w.Write(r.manifests[key])
+	case strings.HasSuffix(p, "/blobs/uploads/"):
+		repo := strings.TrimSuffix(p, "/blobs/uploads/")
+		query := req.URL.Query()
+		digest := query.Get("mount")
+		if digest != "" && !r.noMount[digest] && r.repoBlobs[query.Get("from")+"@"+digest] {
+			r.repoBlobs[repo+"@"+digest] = true
+			r.mounts++
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/1?state=abc")
+		w.WriteHeader(http.StatusAccepted)
+	case strings.Contains(p, "/blobs/uploads/"):
+		repo := strings.SplitN(p, "/blobs/uploads/", 2)[0]
+		digest := req.URL.Query().Get("digest")
+		b, _ := ioutil.ReadAll(req.Body)
+		if digestOf(b) != digest || req.URL.Query().Get("state") != "abc" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.addBlob(repo, b)
+		r.uploads++
+		w.WriteHeader(http.StatusCreated)
+	case strings.Contains(p, "/blobs/"):
+		parts := strings.SplitN(p, "/blobs/", 2)
+		if !r.repoBlobs[parts[0]+"@"+parts[1]] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if req.Method == "GET" {
+			w.Write(r.blobs[parts[1]])
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// registryTestClient returns a client logged in to the registry as user.
+func registryTestClient(t *testing.T, r *fakeRegistry) *RegistryClient {
+	dir, err := ioutil.TempDir("", "docker-squash-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	config := fmt.Sprintf(`{"auths":{"%s":{"auth":"%s"}}}`, r.host(),
+		base64.StdEncoding.EncodeToString([]byte("user:pass")))
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	old := os.Getenv("DOCKER_CONFIG")
+	os.Setenv("DOCKER_CONFIG", dir)
+	defer os.Setenv("DOCKER_CONFIG", old)
+
+	c, err := NewRegistryClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRegistryPullPush(t *testing.T) {
+	r := newFakeRegistry(t)
+
+	// three layers and an ENV step, in the repository src
+	layers := [][]byte{
+		testTar(map[string]string{"etc/base": "base"}),
+		testTar(map[string]string{"app/a": "a"}),
+		testTar(map[string]string{"app/b": "b"}),
+	}
+	manifest := ociManifest{SchemaVersion: 2, MediaType: mediaTypeManifest}
+	config := imageConfig{Config: &Config{Env: []string{"A=1"}}}
+	config.RootFS.Type = "layers"
+	for i, layer := range layers {
+		blob := gzipped(layer)
+		manifest.Layers = append(manifest.Layers, ociDescriptor{MediaType: mediaTypeLayer,
+			Digest: r.addBlob("src", blob), Size: int64(len(blob))})
+		config.RootFS.DiffIds = append(config.RootFS.DiffIds, digestOf(layer))
+		config.History = append(config.History, historyEntry{Created: "2020-01-01T00:00:00Z",
+			CreatedBy: fmt.Sprintf("/bin/sh -c step%d", i)})
+	}
+	config.History = append(config.History, historyEntry{CreatedBy: "/bin/sh -c #(nop) ENV A=1", EmptyLayer: true})
+	configJson, _ := json.Marshal(config)
+	manifest.Config = ociDescriptor{MediaType: mediaTypeConfig, Digest: r.addBlob("src", configJson),
+		Size: int64(len(configJson))}
+	r.manifests["src:latest"], _ = json.Marshal(manifest)
+
+	// dst already has the first layer, and the second can't be mounted
+	r.repoBlobs["dst@"+manifest.Layers[0].Digest] = true
+	r.noMount[manifest.Layers[1].Digest] = true
+
+	c := registryTestClient(t, r)
+	src, _ := ParseRegistryRef("registry://" + r.host() + "/src:latest")
+	dst, _ := ParseRegistryRef("registry://" + r.host() + "/dst:squashed")
+
+	dir, err := ioutil.TempDir("", "docker-squash-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	export, pulled, err := c.Pull(src, filepath.Join(dir, "image"), filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := export.Chain()
+	if len(chain) != 4 {
+		t.Fatalf("pulled %d layers, want 4", len(chain))
+	}
+	if !chain[3].MetadataOnly() {
+		t.Errorf("ENV layer %s is not metadata only", chain[3].LayerConfig.Id[:12])
+	}
+
+	// the third layer is pushed as a new layer
+	delete(pulled.Layers, chain[2].LayerConfig.Id)
+
+	if _, err := c.Push(export, pulled, dst, Uncompressed, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	pushed := ociManifest{}
+	if err := json.Unmarshal(r.manifests["dst:squashed"], &pushed); err != nil {
+		t.Fatal(err)
+	}
+	pushedConfig := imageConfig{}
+	if err := json.Unmarshal(r.blobs[pushed.Config.Digest], &pushedConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pushed.Layers) != 3 {
+		t.Fatalf("pushed %d layers, want 3", len(pushed.Layers))
+	}
+	for i := 0; i < 2; i++ {
+		if pushed.Layers[i].Digest != manifest.Layers[i].Digest {
+			t.Errorf("layer %d is %s, want %s", i, pushed.Layers[i].Digest, manifest.Layers[i].Digest)
+		}
+	}
+	if d := pushedConfig.RootFS.DiffIds; len(d) != 3 || d[2] != config.RootFS.DiffIds[2] {
+		t.Errorf("got diff_ids %v, want %v", d, config.RootFS.DiffIds)
+	}
+	if h := pushedConfig.History; len(h) != 4 || !h[3].EmptyLayer {
+		t.Errorf("got history %v, want an empty ENV layer last", h)
+	}
+	if pushedConfig.Config == nil || len(pushedConfig.Config.Env) != 1 || pushedConfig.Config.Env[0] != "A=1" {
+		t.Errorf("got config %v, want the env of the source", pushedConfig.Config)
+	}
+
+	// the first layer exists, the second is uploaded when the mount is
+	// refused, and the new layer and the config are uploaded
+	if r.mounts != 0 || r.uploads != 3 {
+		t.Errorf("got %d mounts and %d uploads, want 0 and 3", r.mounts, r.uploads)
+	}
+}
+
+func TestRegistryMountAndRenew(t *testing.T) {
+	r := newFakeRegistry(t)
+
+	layer := testTar(map[string]string{"etc/base": "base"})
+	blob := gzipped(layer)
+	config := imageConfig{History: []historyEntry{{CreatedBy: "/bin/sh -c step"}}}
+	config.RootFS = rootFS{Type: "layers", DiffIds: []string{digestOf(layer)}}
+	configJson, _ := json.Marshal(config)
+	manifest := ociManifest{SchemaVersion: 2, MediaType: mediaTypeManifest,
+		Config: ociDescriptor{MediaType: mediaTypeConfig, Digest: r.addBlob("src", configJson), Size: int64(len(configJson))},
+		Layers: []ociDescriptor{{MediaType: mediaTypeLayer, Digest: r.addBlob("src", blob), Size: int64(len(blob))}},
+	}
+	r.manifests["src:latest"], _ = json.Marshal(manifest)
+
+	c := registryTestClient(t, r)
+	src, _ := ParseRegistryRef("registry://" + r.host() + "/src:latest")
+
+	dir, err := ioutil.TempDir("", "docker-squash-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	export, pulled, err := c.Pull(src, filepath.Join(dir, "image"), filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tag := range []string{"one", "two"} {
+		if i > 0 {
+			// the cached token expires between pushes
+			r.expire()
+		}
+		dst, _ := ParseRegistryRef("registry://" + r.host() + "/dst:" + tag)
+		if _, err := c.Push(export, pulled, dst, Uncompressed, 0); err != nil {
+			t.Fatal(err)
+		}
+		if r.manifests["dst:"+tag] == nil {
+			t.Errorf("dst:%s was not pushed", tag)
+		}
+	}
+
+	if r.mounts != 1 {
+		t.Errorf("got %d mounts, want 1", r.mounts)
+	}
+	if r.issued != 3 {
+		t.Errorf("issued %d tokens, want 3: pull, push and renewed push", r.issued)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sourceDate is the time stamped on the new layers and files of a
+// reproducible squash.  It is zero for the current time.
+var sourceDate time.Time
+
+// now returns the creation time of new layers.
+func now() time.Time {
+	if !sourceDate.IsZero() {
+		return sourceDate
+	}
+	return time.Now().UTC()
+}
+
+// SourceDate returns the time set by SOURCE_DATE_EPOCH or, if it isn't set,
+// the creation time of the newest layer of the export.
+func (e *Export) SourceDate() (time.Time, error) {
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return time.Time{}, errors.New(fmt.Sprintf("bad SOURCE_DATE_EPOCH: %s", epoch))
+		}
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+
+	newest := time.Unix(0, 0).UTC()
+	for _, entry := range e.Entries {
+		if entry.LayerConfig.Created.After(newest) {
+			newest = entry.LayerConfig.Created.UTC()
+		}
+	}
+	return newest.Truncate(time.Second), nil
+}
+
+// reproducibleTarArgs returns the tar options making archives of the same
+// files identical: entries sorted by name, mtimes clamped to sourceDate and
+// PAX headers without access and change times.  Owners are stored by number
+// only.
+func reproducibleTarArgs() []string {
+	if sourceDate.IsZero() {
+		return nil
+	}
+	return []string{
+		"--sort=name",
+		fmt.Sprintf("--mtime=@%d", sourceDate.Unix()),
+		"--clamp-mtime",
+		"--numeric-owner",
+		"--format=posix",
+		"--pax-option=exthdr.name=%d/PaxHeaders/%f,delete=atime,delete=ctime",
+	}
+}
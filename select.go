@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Select returns the layer matching a selector.  Besides a layer ID prefix
+// and root, a selector can be one of:
+//
+//	cmd:/regexp/    the layer whose command matches regexp
+//	index:N         the Nth layer from the root, starting at 0
+//	label:NAME      the layer introducing label NAME, or changing its value
+//	after:PATTERN   the layer above the one whose command contains PATTERN
+//
+// An error is returned if no layer or more than one layer matches.
+func (e *Export) Select(selector string) (*ExportedImage, error) {
+	if selector == "root" {
+		return e.Root(), nil
+	}
+
+	kind, value := "", selector
+	if i := strings.Index(selector, ":"); i != -1 {
+		kind, value = selector[:i], selector[i+1:]
+	}
+
+	chain := e.Chain()
+	matches := []*ExportedImage{}
+	switch kind {
+	case "cmd":
+		if len(value) > 1 && strings.HasPrefix(value, "/") && strings.HasSuffix(value, "/") {
+			value = value[1 : len(value)-1]
+		}
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("bad selector %s: %s", selector, err))
+		}
+
+		for _, entry := range chain {
+			if re.MatchString(layerCmd(entry)) {
+				matches = append(matches, entry)
+			}
+		}
+	case "index":
+		i, err := strconv.Atoi(value)
+		if err != nil || i < 0 {
+			return nil, errors.New(fmt.Sprintf("bad selector %s: index must be a non-negative number", selector))
+		}
+		if i < len(chain) {
+			matches = append(matches, chain[i])
+		}
+	case "label":
+		// layers inherit the labels of their parent
+		parentLabel, parentOk := "", false
+		for _, entry := range chain {
+			label, ok := layerLabel(entry, value)
+			if ok && (!parentOk || label != parentLabel) {
+				matches = append(matches, entry)
+			}
+			parentLabel, parentOk = label, ok
+		}
+	case "after":
+		for i, entry := range chain {
+			if strings.Contains(layerCmd(entry), value) && i+1 < len(chain) {
+				matches = append(matches, chain[i+1])
+			}
+		}
+	default:
+		entry, err := e.GetById(selector)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			matches = append(matches, entry)
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil, errors.New(fmt.Sprintf("no layer matching %s", selector))
+	}
+
+	if len(matches) > 1 {
+		ids := []string{}
+		for _, m := range matches {
+			ids = append(ids, m.LayerConfig.Id[:12])
+		}
+		return nil, errors.New(fmt.Sprintf("%s is ambiguous. %d matched: %s", selector,
+			len(matches), strings.Join(ids, ", ")))
+	}
+
+	return matches[0], nil
+}
+
+// layerLabel returns the value of a label of the layer config, and whether
+// the layer has it.
+func layerLabel(entry *ExportedImage, name string) (string, bool) {
+	if entry.LayerConfig.Config == nil {
+		return "", false
+	}
+	label, ok := entry.LayerConfig.Config.Labels[name]
+	return label, ok
+}
+
+func layerCmd(entry *ExportedImage) string {
+	return strings.Join(entry.LayerConfig.ContainerConfig().Cmd, " ")
+}
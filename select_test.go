@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// selectTestExport returns an export with a layer for each command, labelled
+// with the labels of the same index, and the IDs of its layers.
+func selectTestExport(t *testing.T, cmds []string, labels []map[string]string) (*Export, []string) {
+	export := testExport(t)
+	ids := []string{}
+	parent := ""
+	for i, cmd := range cmds {
+		addTestLayer(t, export, parent, cmd, testTar(nil))
+		entry := export.LastChild()
+		if labels[i] != nil {
+			entry.LayerConfig.Config = &Config{Labels: labels[i]}
+		}
+		parent = entry.LayerConfig.Id
+		ids = append(ids, parent)
+	}
+	return export, ids
+}
+
+func TestSelect(t *testing.T) {
+	base := map[string]string{"vendor": "base"}
+	app := map[string]string{"vendor": "app", "version": "1"}
+	export, ids := selectTestExport(t, []string{
+		"/bin/sh -c #(nop) ADD file:1234 in /",
+		"/bin/sh -c #(nop) LABEL vendor=base",
+		"/bin/sh -c apt-get install -y curl",
+		"/bin/sh -c #(nop) LABEL vendor=app version=1",
+		"/bin/sh -c #(nop) COPY dir:5678 in /app",
+		"/bin/sh -c make -C /app",
+	}, []map[string]string{nil, base, base, app, app, app})
+
+	tests := []struct {
+		selector string
+		want     int
+	}{
+		{"root", 0},
+		{ids[2][:12], 2},
+		{"cmd:/apt-get/", 2},
+		{`cmd:/COPY .* \/app/`, 4},
+		{"cmd:make", 5},
+		{"index:0", 0},
+		{"index:5", 5},
+		{"label:version", 3},
+		{"after:apt-get", 3},
+		{"after:ADD", 1},
+	}
+	for _, test := range tests {
+		entry, err := export.Select(test.selector)
+		if err != nil {
+			t.Errorf("%s: %s", test.selector, err)
+			continue
+		}
+		if entry.LayerConfig.Id != ids[test.want] {
+			t.Errorf("%s selected %s, want layer %d", test.selector, entry.LayerConfig.Id[:12], test.want)
+		}
+	}
+
+	errs := []struct {
+		selector, err string
+	}{
+		{"cmd:/nothing/", "no layer matching"},
+		{"cmd:/LABEL/", "ambiguous. 2 matched"},
+		{"cmd:/(/", "bad selector"},
+		{"index:6", "no layer matching"},
+		{"index:-1", "non-negative"},
+		{"index:one", "non-negative"},
+		{"label:maintainer", "no layer matching"},
+		{"label:vendor", "ambiguous. 2 matched: " + ids[1][:12] + ", " + ids[3][:12]},
+		{"after:make", "no layer matching"},
+		{"after:#(nop)", "ambiguous"},
+	}
+	for _, test := range errs {
+		_, err := export.Select(test.selector)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.selector, err, test.err)
+		}
+	}
+}
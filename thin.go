@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Unchanged returns the layers from the root up to the start of the lowest
+// range.  The squash leaves them as they are, so a thin archive can leave
+// them out when the target already has them.
+func (e *Export) Unchanged(ranges []*SquashRange) []*ExportedImage {
+	lowest := map[*ExportedImage]bool{}
+	for _, r := range ranges {
+		lowest[r.Start] = true
+	}
+
+	unchanged := []*ExportedImage{}
+	for _, entry := range e.Chain() {
+		unchanged = append(unchanged, entry)
+		if lowest[entry] {
+			break
+		}
+	}
+	return unchanged
+}
+
+// readKnownLayers reads the ids of the layers present on the target, one per
+// line as named by the layer dirs of a docker save archive.  Ids may be
+// truncated.
+func readKnownLayers(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	known := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		id := strings.TrimPrefix(strings.TrimSpace(scanner.Text()), "sha256:")
+		if id == "" || strings.HasPrefix(id, "#") {
+			continue
+		}
+		known = append(known, id)
+	}
+	return known, scanner.Err()
+}
+
+// checkKnownLayers returns an error naming the layers left out of a thin
+// archive that the target doesn't have.
+func checkKnownLayers(layers []*ExportedImage, known []string) error {
+	missing := []string{}
+	for _, entry := range layers {
+		found := false
+		for _, id := range known {
+			if strings.HasPrefix(entry.LayerConfig.Id, id) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, entry.LayerConfig.Id[:12])
+		}
+	}
+
+	if len(missing) > 0 {
+		return errors.New(fmt.Sprintf("target is missing layers left out of the thin archive: %s",
+			strings.Join(missing, ", ")))
+	}
+	return nil
+}
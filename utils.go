@@ -10,12 +10,38 @@ import (
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/docker/docker/pkg/units"
 )
 
-func extractTar(src, dest string) ([]byte, error) {
-	cmd := exec.Command(TarCmd, "--same-owner", "--xattrs", "--overwrite",
-		"--preserve-permissions", "-xf", src, "-C", dest)
+// extractTar extracts the layer tar src into dest, leaving out the entries
+// named in excludes.  Extended attributes of every namespace are extracted,
+// such as security.capability, and ACLs with them as system.posix_acl_*
+// attributes, which --acls would skip.  If members are given, only those
+// entries are extracted, without the entries below them.
+func extractTar(src, dest string, excludes []string, members ...string) ([]byte, error) {
+	r, err := openLayerTar(src)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	args := []string{"--same-owner", "--xattrs", "--xattrs-include=*", "--overwrite",
+		"--preserve-permissions"}
+	if len(excludes) > 0 {
+		args = append(args, "--anchored", "--no-wildcards")
+		for _, name := range excludes {
+			args = append(args, "--exclude="+name)
+		}
+	}
+	if len(members) > 0 {
+		args = append(args, "--no-recursion")
+	}
+	args = append(args, "-xf", "-", "-C", dest)
+	cmd := exec.Command(TarCmd, append(args, members...)...)
+	cmd.Stdin = r
 	return cmd.CombinedOutput()
 }
 
@@ -87,3 +113,36 @@ func readJsonFile(path string, dest interface{}) error {
 	}
 	return nil
 }
+
+// stringsFlag is a flag.Value collecting each occurrence of a repeated flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// sizeFlag is a flag.Value for a size in bytes, such as 512m or 4g.
+type sizeFlag struct {
+	size *int64
+}
+
+func (s sizeFlag) String() string {
+	if s.size == nil {
+		return ""
+	}
+	return strconv.FormatInt(*s.size, 10)
+}
+
+func (s sizeFlag) Set(value string) error {
+	size, err := units.RAMInBytes(value)
+	if err != nil {
+		return err
+	}
+	*s.size = size
+	return nil
+}
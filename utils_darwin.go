@@ -1,5 +0,0 @@
-// +build darwin
-
-package main
-
-const TarCmd = "gtar"
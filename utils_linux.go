@@ -0,0 +1,79 @@
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+const TarCmd = "tar"
+
+// xattrNames returns the names of the extended attributes of a file.
+func xattrNames(p string) ([]string, error) {
+	size, err := syscall.Listxattr(p, nil)
+	if err == syscall.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil || size == 0 {
+		return nil, err
+	}
+
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(p, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	names := strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00")
+	sort.Strings(names)
+	return names, nil
+}
+
+// listXattrs returns the extended attributes of a file as sorted name=value
+// pairs.
+func listXattrs(p string) ([]string, error) {
+	names, err := xattrNames(p)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := []string{}
+	for _, name := range names {
+		size, err := syscall.Getxattr(p, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		size, err = syscall.Getxattr(p, name, value)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, fmt.Sprintf("%s=%q", name, value[:size]))
+	}
+	return attrs, nil
+}
+
+// setXattrs makes attrs the extended attributes of a file, removing the
+// others.  SELinux labels are left to the host.
+func setXattrs(p string, attrs map[string]string) error {
+	names, err := xattrNames(p)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, ok := attrs[name]; !ok && name != selinuxXattr {
+			if err := syscall.Removexattr(p, name); err != nil {
+				return err
+			}
+		}
+	}
+	for name, value := range attrs {
+		if err := syscall.Setxattr(p, name, []byte(value), 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"runtime"
+)
+
+const TarCmd = "gtar"
+
+var errXattrs = errors.New("extended attributes are not supported on " + runtime.GOOS)
+
+// listXattrs returns the extended attributes of a file as sorted name=value
+// pairs.  Extracted files have none, as setXattrs can't set them.
+func listXattrs(p string) ([]string, error) {
+	return nil, nil
+}
+
+// setXattrs makes attrs the extended attributes of a file, removing the
+// others.
+func setXattrs(p string, attrs map[string]string) error {
+	if len(attrs) > 0 {
+		return errXattrs
+	}
+	return nil
+}
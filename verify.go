@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+func runVerify(args []string) {
+	var keepTemp bool
+	var excludes, configExcludes stringsFlag
+
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	flags.Var(&excludes, "exclude", "Ignore paths matching pattern (may be repeated)")
+	flags.Var(&configExcludes, "exclude-config", "Ignore a field of the runtime config, such as Labels (may be repeated)")
+	flags.BoolVar(&keepTemp, "keepTemp", false, "Keep temp dir when done. (Useful for debugging)")
+	flags.BoolVar(&verbose, "verbose", false, "Enable verbose logging")
+	flags.Usage = func() {
+		fmt.Printf("\nUsage: docker-squash verify [options] original.tar squashed.tar\n\n")
+		fmt.Printf("Checks that a squashed image has the same filesystem and runtime config as the original\n\n")
+		fmt.Printf("Options:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	tempdir := setupTempdir(keepTemp)
+
+	for _, field := range configExcludes {
+		if !isRuntimeConfigField(field) {
+			fatalf("%s is not a runtime config field. Use one of %s\n", field,
+				strings.Join(runtimeConfigFields, ", "))
+		}
+	}
+
+	original, err := LoadExport(flags.Arg(0), filepath.Join(tempdir, "a"))
+	if err != nil {
+		fatal(err)
+	}
+
+	squashed, err := LoadExport(flags.Arg(1), filepath.Join(tempdir, "b"))
+	if err != nil {
+		fatal(err)
+	}
+
+	differences, err := compareExports(original, squashed, excludes)
+	if err != nil {
+		fatal(err)
+	}
+	differences = append(differences, compareConfigs(original.LastChild().LayerConfig.Config,
+		squashed.LastChild().LayerConfig.Config, configExcludes)...)
+
+	for _, d := range differences {
+		fmt.Println(d)
+	}
+	cleanup()
+
+	if len(differences) > 0 {
+		os.Exit(1)
+	}
+	fmt.Println("OK")
+}
+
+// runtimeConfigFields are the fields of Config that change how a container
+// of the image runs.
+var runtimeConfigFields = []string{
+	"User", "ExposedPorts", "Env", "Cmd", "Entrypoint", "WorkingDir", "Volumes",
+	"OnBuild", "Labels",
+}
+
+func isRuntimeConfigField(field string) bool {
+	for _, f := range runtimeConfigFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// compareConfigs describes the runtime fields that differ between two
+// configs, except for the excluded fields.
+func compareConfigs(a, b *Config, excludes []string) []string {
+	if a == nil {
+		a = &Config{}
+	}
+	if b == nil {
+		b = &Config{}
+	}
+
+	skip := map[string]bool{}
+	for _, e := range excludes {
+		skip[e] = true
+	}
+
+	differences := []string{}
+	av, bv := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for _, field := range runtimeConfigFields {
+		if skip[field] {
+			continue
+		}
+
+		af, bf := av.FieldByName(field).Interface(), bv.FieldByName(field).Interface()
+		if !reflect.DeepEqual(af, bf) && !(isEmpty(af) && isEmpty(bf)) {
+			differences = append(differences, fmt.Sprintf("~ config %s: %v != %v", field, af, bf))
+		}
+	}
+	return differences
+}
+
+// isEmpty returns true for nil and empty slices and maps, and empty strings.
+func isEmpty(v interface{}) bool {
+	return reflect.ValueOf(v).Len() == 0
+}